@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// areaFilter is a GeoJSON Polygon or MultiPolygon used as a spatial filter.
+// Each polygon is a list of rings of [longitude, latitude] positions, the
+// first ring being the exterior and the rest holes. Longitudes are unwrapped
+// so no edge spans more than 180 degrees, which leaves rings that cross the
+// antimeridian continuous with longitudes beyond ±180.
+type areaFilter struct {
+	polygons [][][][2]float64
+}
+
+// parseArea accepts a GeoJSON Polygon or MultiPolygon geometry, or a Feature wrapping one
+func parseArea(raw []byte) (*areaFilter, error) {
+	var g struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+		Geometry    json.RawMessage `json:"geometry"`
+	}
+	if err := json.Unmarshal(raw, &g); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %w", err)
+	}
+
+	var polygons [][][][]float64
+	switch g.Type {
+	case "Feature":
+		if len(g.Geometry) == 0 {
+			return nil, fmt.Errorf("feature has no geometry")
+		}
+		return parseArea(g.Geometry)
+	case "Polygon":
+		var rings [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &rings); err != nil {
+			return nil, fmt.Errorf("invalid Polygon coordinates: %w", err)
+		}
+		polygons = [][][][]float64{rings}
+	case "MultiPolygon":
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil {
+			return nil, fmt.Errorf("invalid MultiPolygon coordinates: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("expected a Polygon or MultiPolygon, got %q", g.Type)
+	}
+
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("area has no polygons")
+	}
+
+	area := &areaFilter{}
+	for _, rings := range polygons {
+		if len(rings) == 0 {
+			return nil, fmt.Errorf("polygon has no rings")
+		}
+		var polygon [][][2]float64
+		for _, ring := range rings {
+			positions := make([][2]float64, 0, len(ring)+1)
+			for _, pos := range ring {
+				if len(pos) < 2 {
+					return nil, fmt.Errorf("position needs a longitude and latitude")
+				}
+				if pos[0] < -180 || pos[0] > 180 || pos[1] < -90 || pos[1] > 90 {
+					return nil, fmt.Errorf("position [%g, %g] is out of range", pos[0], pos[1])
+				}
+				positions = append(positions, [2]float64{pos[0], pos[1]})
+			}
+			// GeoJSON rings repeat their first position; close any that do not
+			if len(positions) > 0 && positions[0] != positions[len(positions)-1] {
+				positions = append(positions, positions[0])
+			}
+			if len(positions) < 4 {
+				return nil, fmt.Errorf("ring needs at least three distinct positions")
+			}
+			unwrapRing(positions)
+			if len(polygon) > 0 {
+				// Move holes next to their exterior ring
+				shift := 360 * math.Round((polygon[0][0][0]-positions[0][0])/360)
+				for i := range positions {
+					positions[i][0] += shift
+				}
+			}
+			polygon = append(polygon, positions)
+		}
+		area.polygons = append(area.polygons, polygon)
+	}
+
+	return area, nil
+}
+
+// unwrapRing takes the shorter way round between consecutive positions, so an
+// edge from 170 to -170 runs on to 190 rather than back across the globe
+func unwrapRing(ring [][2]float64) {
+	prev := ring[0][0]
+	for i := 1; i < len(ring); i++ {
+		lon := ring[i][0]
+		ring[i][0] = ring[i-1][0] + normalizeLongitude(lon-prev)
+		prev = lon
+	}
+}
+
+// bbox returns the bounding box of the area as min/max longitude and latitude.
+// The longitudes fall outside ±180 when the area crosses the antimeridian.
+func (a *areaFilter) bbox() (minLon, minLat, maxLon, maxLat float64) {
+	minLon, minLat = math.Inf(1), math.Inf(1)
+	maxLon, maxLat = math.Inf(-1), math.Inf(-1)
+	for _, polygon := range a.polygons {
+		for _, pos := range polygon[0] {
+			minLon, maxLon = math.Min(minLon, pos[0]), math.Max(maxLon, pos[0])
+			minLat, maxLat = math.Min(minLat, pos[1]), math.Max(maxLat, pos[1])
+		}
+	}
+	return minLon, minLat, maxLon, maxLat
+}
+
+const (
+	outsideRing = iota
+	insideRing
+	onRing
+)
+
+// contains reports whether a point lies in any polygon of the area. Points on
+// an exterior ring or a hole's edge count as inside; points within a hole do
+// not. The point is also tried a turn east and west, to meet polygons whose
+// unwrapped longitudes run past ±180.
+func (a *areaFilter) contains(lon, lat float64) bool {
+	for _, polygon := range a.polygons {
+		for _, x := range []float64{lon, lon + 360, lon - 360} {
+			if polygonContains(polygon, x, lat) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func polygonContains(polygon [][][2]float64, x, y float64) bool {
+	if ringLocation(polygon[0], x, y) == outsideRing {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if ringLocation(hole, x, y) == insideRing {
+			return false
+		}
+	}
+	return true
+}
+
+// ringLocation classifies a point against a closed ring using even-odd ray casting
+func ringLocation(ring [][2]float64, x, y float64) int {
+	inside := false
+	for i := 1; i < len(ring); i++ {
+		x1, y1 := ring[i-1][0], ring[i-1][1]
+		x2, y2 := ring[i][0], ring[i][1]
+
+		if onSegment(x1, y1, x2, y2, x, y) {
+			return onRing
+		}
+		if (y1 > y) != (y2 > y) && x < (x2-x1)*(y-y1)/(y2-y1)+x1 {
+			inside = !inside
+		}
+	}
+	if inside {
+		return insideRing
+	}
+	return outsideRing
+}
+
+func onSegment(x1, y1, x2, y2, x, y float64) bool {
+	const eps = 1e-12
+	cross := (x2-x1)*(y-y1) - (y2-y1)*(x-x1)
+	if math.Abs(cross) > eps {
+		return false
+	}
+	return x >= math.Min(x1, x2)-eps && x <= math.Max(x1, x2)+eps &&
+		y >= math.Min(y1, y2)-eps && y <= math.Max(y1, y2)+eps
+}
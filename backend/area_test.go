@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustParseArea(t *testing.T, geojson string) *areaFilter {
+	t.Helper()
+	area, err := parseArea([]byte(geojson))
+	if err != nil {
+		t.Fatalf("parseArea(%s): %v", geojson, err)
+	}
+	return area
+}
+
+func TestAreaContains(t *testing.T) {
+	type point struct {
+		lon, lat float64
+		want     bool
+	}
+	tests := []struct {
+		name    string
+		geojson string
+		points  []point
+	}{
+		{
+			"square",
+			`{"type":"Polygon","coordinates":[[[0,0],[10,0],[10,10],[0,10],[0,0]]]}`,
+			[]point{
+				{5, 5, true},
+				{-1, 5, false},
+				{5, 11, false},
+				{0, 5, true},   // on the west edge
+				{5, 0, true},   // on the south edge
+				{10, 10, true}, // on a vertex
+				{0, 0, true},   // on the first vertex
+				{10.000001, 10, false},
+			},
+		},
+		{
+			"square with a hole",
+			`{"type":"Polygon","coordinates":[[[0,0],[10,0],[10,10],[0,10],[0,0]],[[4,4],[6,4],[6,6],[4,6],[4,4]]]}`,
+			[]point{
+				{5, 5, false}, // in the hole
+				{2, 2, true},
+				{4, 5, true}, // on the hole's edge
+				{6, 6, true}, // on a vertex of the hole
+				{8, 5, true},
+			},
+		},
+		{
+			"concave",
+			`{"type":"Polygon","coordinates":[[[0,0],[10,0],[10,10],[5,5],[0,10],[0,0]]]}`,
+			[]point{
+				{5, 8, false}, // in the notch
+				{5, 4, true},
+				{2, 6, true},
+				{5, 5, true}, // on the notch vertex
+			},
+		},
+		{
+			"unclosed ring",
+			`{"type":"Polygon","coordinates":[[[0,0],[10,0],[10,10],[0,10]]]}`,
+			[]point{{5, 5, true}, {11, 5, false}},
+		},
+		{
+			"MultiPolygon",
+			`{"type":"MultiPolygon","coordinates":[
+				[[[0,0],[10,0],[10,10],[0,10],[0,0]]],
+				[[[20,20],[30,20],[30,30],[20,30],[20,20]],[[24,24],[26,24],[26,26],[24,26],[24,24]]]
+			]}`,
+			[]point{
+				{5, 5, true},
+				{25, 21, true},
+				{25, 25, false}, // in the second polygon's hole
+				{15, 15, false}, // between the polygons
+				{30, 25, true},  // on the second polygon's edge
+			},
+		},
+		{
+			"Feature",
+			`{"type":"Feature","properties":{},"geometry":{"type":"Polygon","coordinates":[[[0,0],[10,0],[10,10],[0,10],[0,0]]]}}`,
+			[]point{{5, 5, true}, {15, 5, false}},
+		},
+		{
+			"Fiji across the antimeridian",
+			`{"type":"Polygon","coordinates":[[[176,-20],[-178,-20],[-178,-15],[176,-15],[176,-20]]]}`,
+			[]point{
+				{178.4, -17.7, true},
+				{-179.1, -17.7, true},
+				{180, -17.7, true},
+				{-180, -17.7, true},
+				{-178, -17.7, true}, // on the east edge
+				{0, -17.7, false},
+				{175, -17.7, false},
+				{-177, -17.7, false},
+			},
+		},
+		{
+			"Aleutians across the antimeridian with a hole",
+			`{"type":"Polygon","coordinates":[
+				[[170,50],[-170,50],[-170,56],[170,56],[170,50]],
+				[[-179,52],[-175,52],[-175,54],[-179,54],[-179,52]]
+			]}`,
+			[]point{
+				{175, 53, true},
+				{-172, 53, true},
+				{-177, 53, false}, // in the hole east of 180
+				{-160, 53, false},
+				{0, 53, false},
+			},
+		},
+		{
+			"MultiPolygon split at the antimeridian",
+			`{"type":"MultiPolygon","coordinates":[
+				[[[170,50],[180,50],[180,56],[170,56],[170,50]]],
+				[[[-180,50],[-170,50],[-170,56],[-180,56],[-180,50]]]
+			]}`,
+			[]point{{175, 53, true}, {-175, 53, true}, {180, 53, true}, {0, 53, false}},
+		},
+	}
+	for _, tt := range tests {
+		area := mustParseArea(t, tt.geojson)
+		for _, p := range tt.points {
+			if got := area.contains(p.lon, p.lat); got != p.want {
+				t.Errorf("%s: contains(%g, %g) = %t, want %t", tt.name, p.lon, p.lat, got, p.want)
+			}
+		}
+	}
+}
+
+func TestParseAreaRejectsInvalidGeometry(t *testing.T) {
+	for _, geojson := range []string{
+		`{"type":"Point","coordinates":[0,0]}`,
+		`{"type":"Polygon","coordinates":[]}`,
+		`{"type":"Polygon","coordinates":[[[0,0],[1,1],[0,0]]]}`,
+		`{"type":"Polygon","coordinates":[[[0,0],[200,0],[0,10],[0,0]]]}`,
+		`{"type":"Polygon","coordinates":[[[0],[10,0],[0,10],[0]]]}`,
+		`{"type":"Feature"}`,
+		`not json`,
+	} {
+		if _, err := parseArea([]byte(geojson)); err == nil {
+			t.Errorf("parseArea accepted %s", geojson)
+		}
+	}
+}
+
+func TestWhereAreaBoundingBox(t *testing.T) {
+	tests := []struct {
+		name       string
+		geojson    string
+		conditions []string
+		args       []interface{}
+	}{
+		{
+			"ordinary",
+			`{"type":"Polygon","coordinates":[[[0,0],[10,0],[10,10],[0,10],[0,0]]]}`,
+			[]string{"longitude BETWEEN $1 AND $2", "latitude BETWEEN $3 AND $4"},
+			[]interface{}{0.0, 10.0, 0.0, 10.0},
+		},
+		{
+			"across the antimeridian",
+			`{"type":"Polygon","coordinates":[[[176,-20],[-178,-20],[-178,-15],[176,-15],[176,-20]]]}`,
+			[]string{"(longitude >= $1 OR longitude <= $2)", "latitude BETWEEN $3 AND $4"},
+			[]interface{}{176.0, -178.0, -20.0, -15.0},
+		},
+	}
+	for _, tt := range tests {
+		f, err := parseEarthquakeFilter(url.Values{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Area = mustParseArea(t, tt.geojson)
+		conditions, args := f.where()
+		if !reflect.DeepEqual(conditions, tt.conditions) || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s: where() = %q %v, want %q %v", tt.name, conditions, args, tt.conditions, tt.args)
+		}
+	}
+}
+
+func TestRequestAreaLimitsBody(t *testing.T) {
+	square := `{"type":"Polygon","coordinates":[[[0,0],[10,0],[10,10],[0,10],[0,0]]]}`
+	r := httptest.NewRequest(http.MethodPost, "/api/go/earthquakes/search", strings.NewReader(square))
+	if area, status, err := requestArea(nil, r, "1"); err != nil || area == nil {
+		t.Fatalf("requestArea = %v, %d, %v", area, status, err)
+	}
+
+	padded := square[:len(square)-1] + `,"padding":"` + strings.Repeat("x", maxAreaBytes) + `"}`
+	r = httptest.NewRequest(http.MethodPost, "/api/go/earthquakes/search", strings.NewReader(padded))
+	if _, status, err := requestArea(nil, r, "1"); err == nil || status != http.StatusRequestEntityTooLarge {
+		t.Errorf("requestArea of an oversized body = %d, %v", status, err)
+	}
+}
+
+func TestRequestAreaRejectsNonNumericRegion(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/go/earthquakes?region_id=abc", nil)
+	if _, status, err := requestArea(nil, r, "1"); err == nil || status != http.StatusBadRequest {
+		t.Errorf("requestArea with region_id=abc = %d, %v", status, err)
+	}
+}
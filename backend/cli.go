@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: earthquake-visualizer <command> [flags]
+
+Commands:
+  serve                                        start the HTTP API (default)
+  migrate                                      create or upgrade the database tables
+  import --format csv|geojson|quakeml <path>   load earthquakes from a file or URL
+  stats                                        print a summary of the earthquakes table
+  decluster --method gardner-knopoff|reasenberg
+                                               mark mainshocks, foreshocks and aftershocks
+
+All commands read the connection string from DATABASE_URL unless
+--database-url is given.
+`)
+}
+
+// openDatabase connects and pings so CLI commands fail fast on a bad connection string
+func openDatabase(databaseURL string) (*sql.DB, error) {
+	if databaseURL == "" {
+		return nil, fmt.Errorf("no database configured: set DATABASE_URL or pass --database-url")
+	}
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	databaseURL := flags.String("database-url", os.Getenv("DATABASE_URL"), "Postgres connection string")
+	flags.Parse(args)
+
+	db, err := openDatabase(*databaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	initializeDatabase(db)
+	fmt.Println("Database is up to date")
+	return nil
+}
+
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "csv", "input format: csv, geojson or quakeml")
+	databaseURL := flags.String("database-url", os.Getenv("DATABASE_URL"), "Postgres connection string")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: earthquake-visualizer import --format csv|geojson|quakeml <path>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	path := flags.Arg(0)
+
+	db, err := openDatabase(*databaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	initializeDatabase(db)
+
+	switch *format {
+	case "csv":
+		report, err := loadEarthquakeData(db, path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Loaded %d earthquakes, rejected %d rows\n", report.Loaded, report.Rejected)
+		for _, r := range report.Rejects {
+			fmt.Printf("  line %d: %s\n", r.Line, r.Reason)
+		}
+	case "geojson":
+		n, err := ingestFeed(db, path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Loaded %d earthquakes\n", n)
+	case "quakeml":
+		n, err := ingestQuakeML(db, path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Loaded %d earthquakes\n", n)
+	default:
+		return fmt.Errorf("unknown format %q: expected csv, geojson or quakeml", *format)
+	}
+	return nil
+}
+
+func runStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	databaseURL := flags.String("database-url", os.Getenv("DATABASE_URL"), "Postgres connection string")
+	flags.Parse(args)
+
+	db, err := openDatabase(*databaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var count int
+	var first, last sql.NullTime
+	var minMag, maxMag sql.NullFloat64
+	err = db.QueryRow(`
+	SELECT COUNT(*), MIN(time), MAX(time), MIN(magnitude), MAX(magnitude)
+	FROM earthquakes`).Scan(&count, &first, &last, &minMag, &maxMag)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Earthquakes:  %d\n", count)
+	if count == 0 {
+		return nil
+	}
+	fmt.Printf("Time range:   %s to %s\n", first.Time.Format(time.RFC3339), last.Time.Format(time.RFC3339))
+	fmt.Printf("Magnitudes:   %.1f to %.1f\n", minMag.Float64, maxMag.Float64)
+
+	rows, err := db.Query(`
+	SELECT FLOOR(magnitude)::int AS band, COUNT(*)
+	FROM earthquakes
+	WHERE magnitude IS NOT NULL
+	GROUP BY band
+	ORDER BY band`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	fmt.Println("By magnitude:")
+	for rows.Next() {
+		var band, n int
+		if err := rows.Scan(&band, &n); err != nil {
+			return err
+		}
+		fmt.Printf("  M%d-%d: %d\n", band, band+1, n)
+	}
+	return rows.Err()
+}
+
+func runDecluster(args []string) error {
+	flags := flag.NewFlagSet("decluster", flag.ExitOnError)
+	method := flags.String("method", "gardner-knopoff", "declustering method: gardner-knopoff or reasenberg")
+	databaseURL := flags.String("database-url", os.Getenv("DATABASE_URL"), "Postgres connection string")
+	flags.Parse(args)
+
+	db, err := openDatabase(*databaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	initializeDatabase(db)
+
+	n, err := declusterEarthquakes(db, *method)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Found %d clusters\n", n)
+	return nil
+}
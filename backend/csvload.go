@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvColumns maps accepted header names to the earthquake field they fill
+var csvColumns = map[string]string{
+	"id":        "event_id",
+	"event_id":  "event_id",
+	"time":      "time",
+	"latitude":  "latitude",
+	"longitude": "longitude",
+	"depth":     "depth",
+	"mag":       "magnitude",
+	"magnitude": "magnitude",
+	"magtype":   "magnitude_type",
+	"mag_type":  "magnitude_type",
+	"place":     "place",
+	"alert":     "alert",
+	"tsunami":   "tsunami",
+	"url":       "url",
+}
+
+// maxReportedRejects bounds how many rejected rows a csvLoadReport keeps
+const maxReportedRejects = 1000
+
+type csvReject struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+type csvLoadReport struct {
+	Loaded   int         `json:"loaded"`
+	Rejected int         `json:"rejected"`
+	Rejects  []csvReject `json:"rejects"`
+}
+
+func (r *csvLoadReport) reject(line int, reason string) {
+	log.Printf("Rejecting CSV line %d: %s", line, reason)
+	r.Rejected++
+	if len(r.Rejects) < maxReportedRejects {
+		r.Rejects = append(r.Rejects, csvReject{Line: line, Reason: reason})
+	}
+}
+
+// loadEarthquakeData streams a CSV file into the earthquakes table
+func loadEarthquakeData(db *sql.DB, filePath string) (csvLoadReport, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return csvLoadReport{}, err
+	}
+	defer file.Close()
+
+	return loadEarthquakeCSV(db, file)
+}
+
+// loadEarthquakeCSV reads rows one at a time, mapping columns by header name,
+// and upserts them in batches inside a single transaction. Rows that cannot
+// be parsed are recorded in the report and skipped.
+func loadEarthquakeCSV(db *sql.DB, r io.Reader) (csvLoadReport, error) {
+	var report csvLoadReport
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return report, fmt.Errorf("reading CSV header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		if field, ok := csvColumns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[field] = i
+		}
+	}
+	for _, field := range []string{"time", "latitude", "longitude", "magnitude"} {
+		if _, ok := columns[field]; !ok {
+			return report, fmt.Errorf("CSV header is missing a %s column", field)
+		}
+	}
+	_, hasID := columns["event_id"]
+	_, hasURL := columns["url"]
+	if !hasID && !hasURL {
+		return report, fmt.Errorf("CSV header needs an id or url column to identify events")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	batch := make([]Earthquake, 0, upsertBatchSize)
+	lines := make([]int, 0, upsertBatchSize)
+	flush := func() error {
+		// upsertEarthquakeBatch keeps only the last row of each event id
+		last := make(map[string]int, len(batch))
+		for i, e := range batch {
+			last[e.EventId] = i
+		}
+		for i, e := range batch {
+			if j := last[e.EventId]; j != i {
+				report.reject(lines[i], fmt.Sprintf("duplicate event id %s, superseded by line %d", e.EventId, lines[j]))
+			}
+		}
+
+		n, err := upsertEarthquakeBatch(tx, batch)
+		if err != nil {
+			return err
+		}
+		report.Loaded += n
+		batch, lines = batch[:0], lines[:0]
+		return nil
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			report.reject(parseErr.Line, parseErr.Err.Error())
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		e, err := parseCSVEarthquake(record, columns)
+		if err != nil {
+			report.reject(line, err.Error())
+			continue
+		}
+
+		batch = append(batch, e)
+		lines = append(lines, line)
+		if len(batch) == upsertBatchSize {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return report, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+
+	log.Printf("Loaded %d earthquakes from CSV, rejected %d rows", report.Loaded, report.Rejected)
+	return report, nil
+}
+
+func parseCSVEarthquake(record []string, columns map[string]int) (Earthquake, error) {
+	field := func(name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	number := func(name string) (float64, error) {
+		v, err := strconv.ParseFloat(field(name), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q", name, field(name))
+		}
+		return v, nil
+	}
+
+	var e Earthquake
+	var err error
+
+	if e.Time, err = parseCSVTime(field("time")); err != nil {
+		return e, err
+	}
+	if e.Latitude, err = number("latitude"); err != nil {
+		return e, err
+	}
+	if e.Longitude, err = number("longitude"); err != nil {
+		return e, err
+	}
+	if e.Magnitude, err = number("magnitude"); err != nil {
+		return e, err
+	}
+	if field("depth") != "" {
+		if e.Depth, err = number("depth"); err != nil {
+			return e, err
+		}
+	}
+	if field("tsunami") != "" {
+		tsunami, err := number("tsunami")
+		if err != nil {
+			return e, err
+		}
+		e.Tsunami = int(tsunami)
+	}
+	e.MagnitudeType = field("magnitude_type")
+	e.Place = field("place")
+	e.Alert = field("alert")
+	e.URL = field("url")
+
+	e.EventId = field("event_id")
+	if e.EventId == "" {
+		e.EventId = eventIDFromURL(e.URL)
+	}
+	if e.EventId == "" {
+		return e, fmt.Errorf("missing event id")
+	}
+
+	return e, nil
+}
+
+// parseCSVTime accepts Unix milliseconds or an RFC 3339 timestamp as exported by USGS
+func parseCSVTime(val string) (time.Time, error) {
+	if ms, err := strconv.ParseFloat(val, 64); err == nil {
+		return time.UnixMilli(int64(ms)).UTC(), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, val); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", val)
+}
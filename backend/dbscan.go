@@ -0,0 +1,317 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DBSCAN defaults. Two events are neighbours when their distance, scaled by
+// epsKm, and time apart, scaled by epsDays, lie within the unit circle.
+const (
+	defaultEpsKm         = 10.0
+	defaultEpsDays       = 7.0
+	defaultMinPoints     = 5
+	maxDBSCANEarthquakes = 50000
+)
+
+var errTooManyEarthquakes = errors.New("Too many earthquakes to cluster, narrow the filters")
+
+// dbscan labels each event with a cluster number from 0, or -1 for noise.
+// An event with at least minPoints neighbours, itself included, is a core
+// point; clusters are the core points reachable from each other plus the
+// events next to them (Ester et al., 1996). epsDays of zero ignores time.
+func dbscan(events []Earthquake, epsKm, epsDays float64, minPoints int) []int {
+	// Sort an index by latitude so only a band of rows needs checking
+	byLatitude := make([]int, len(events))
+	for i := range byLatitude {
+		byLatitude[i] = i
+	}
+	sort.Slice(byLatitude, func(a, b int) bool {
+		return events[byLatitude[a]].Latitude < events[byLatitude[b]].Latitude
+	})
+	position := make([]int, len(events))
+	for p, i := range byLatitude {
+		position[i] = p
+	}
+	band := epsKm / kmPerDegree
+
+	neighbours := func(i int) []int {
+		e := events[i]
+		var found []int
+		scan := func(p int) bool {
+			o := events[byLatitude[p]]
+			if math.Abs(o.Latitude-e.Latitude) > band {
+				return false
+			}
+			d := haversineKm(e.Latitude, e.Longitude, o.Latitude, o.Longitude) / epsKm
+			scaled := d * d
+			if epsDays > 0 {
+				t := math.Abs(daysBetween(e.Time, o.Time)) / epsDays
+				scaled += t * t
+			}
+			if scaled <= 1 {
+				found = append(found, byLatitude[p])
+			}
+			return true
+		}
+		for p := position[i]; p >= 0; p-- {
+			if !scan(p) {
+				break
+			}
+		}
+		for p := position[i] + 1; p < len(events); p++ {
+			if !scan(p) {
+				break
+			}
+		}
+		return found
+	}
+
+	const unvisited, noise = -2, -1
+	labels := make([]int, len(events))
+	for i := range labels {
+		labels[i] = unvisited
+	}
+	cluster := 0
+	for i := range events {
+		if labels[i] != unvisited {
+			continue
+		}
+		seeds := neighbours(i)
+		if len(seeds) < minPoints {
+			labels[i] = noise
+			continue
+		}
+		// Label events as they are queued so each is expanded at most once
+		// and the queue never holds more than one entry per event. Noise
+		// becomes a border point; it is known not to be a core point.
+		labels[i] = cluster
+		var queue []int
+		claim := func(js []int) {
+			for _, j := range js {
+				switch labels[j] {
+				case noise:
+					labels[j] = cluster
+				case unvisited:
+					labels[j] = cluster
+					queue = append(queue, j)
+				}
+			}
+		}
+		claim(seeds)
+		for k := 0; k < len(queue); k++ {
+			if more := neighbours(queue[k]); len(more) >= minPoints {
+				claim(more)
+			}
+		}
+		cluster++
+	}
+	return labels
+}
+
+// convexHull returns the convex hull of points as a closed counter-clockwise
+// ring, by Andrew's monotone chain
+func convexHull(points [][2]float64) [][2]float64 {
+	pts := append([][2]float64(nil), points...)
+	sort.Slice(pts, func(i, j int) bool {
+		if pts[i][0] != pts[j][0] {
+			return pts[i][0] < pts[j][0]
+		}
+		return pts[i][1] < pts[j][1]
+	})
+	cross := func(o, a, b [2]float64) float64 {
+		return (a[0]-o[0])*(b[1]-o[1]) - (a[1]-o[1])*(b[0]-o[0])
+	}
+
+	var hull [][2]float64
+	for _, p := range pts {
+		for len(hull) >= 2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	for i, lower := len(pts)-2, len(hull)+1; i >= 0; i-- {
+		for len(hull) >= lower && cross(hull[len(hull)-2], hull[len(hull)-1], pts[i]) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, pts[i])
+	}
+	return hull
+}
+
+// swarm summarizes one DBSCAN cluster. Hull is the convex hull of the
+// epicentres as a closed ring of [longitude, latitude] pairs; it has fewer
+// than four points when the epicentres are collinear or coincide.
+type swarm struct {
+	Id           int          `json:"id"`
+	Count        int          `json:"count"`
+	Latitude     float64      `json:"latitude"`
+	Longitude    float64      `json:"longitude"`
+	Start        time.Time    `json:"start"`
+	End          time.Time    `json:"end"`
+	MaxMagnitude float64      `json:"max_magnitude"`
+	MeanDepth    float64      `json:"mean_depth"`
+	EnergyJoules float64      `json:"energy_joules"`
+	Hull         [][2]float64 `json:"hull"`
+	Members      []int        `json:"members"`
+}
+
+// summarizeSwarm describes the events of a cluster. Longitudes are unwrapped
+// around the first event so clusters across the antimeridian stay in one piece.
+func summarizeSwarm(id int, events []Earthquake) swarm {
+	s := swarm{Id: id, Count: len(events), Start: events[0].Time, End: events[0].Time, MaxMagnitude: events[0].Magnitude}
+	origin := events[0].Longitude
+	points := make([][2]float64, 0, len(events))
+	for _, e := range events {
+		lon := origin + normalizeLongitude(e.Longitude-origin)
+		points = append(points, [2]float64{lon, e.Latitude})
+		s.Longitude += lon / float64(len(events))
+		s.Latitude += e.Latitude / float64(len(events))
+		s.MeanDepth += e.Depth / float64(len(events))
+		s.EnergyJoules += seismicEnergyJoules(e.Magnitude)
+		s.MaxMagnitude = math.Max(s.MaxMagnitude, e.Magnitude)
+		if e.Time.Before(s.Start) {
+			s.Start = e.Time
+		}
+		if e.Time.After(s.End) {
+			s.End = e.Time
+		}
+		s.Members = append(s.Members, e.Id)
+	}
+	s.Longitude = normalizeLongitude(s.Longitude)
+	s.Hull = convexHull(points)
+	return s
+}
+
+// find swarms among the earthquakes matching the getEarthquakes filters with
+// DBSCAN over epicentral distance and time
+func getEarthquakeClusters(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		filter, status, err := requestFilter(db, r, userID)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		query := r.URL.Query()
+		epsKm, epsDays := defaultEpsKm, defaultEpsDays
+		if v, err := floatParam(query, "eps_km"); err != nil || (v != nil && *v <= 0) {
+			http.Error(w, "Invalid eps_km value", http.StatusBadRequest)
+			return
+		} else if v != nil {
+			epsKm = *v
+		}
+		if v, err := floatParam(query, "eps_days"); err != nil || (v != nil && *v < 0) {
+			http.Error(w, "Invalid eps_days value", http.StatusBadRequest)
+			return
+		} else if v != nil {
+			epsDays = *v
+		}
+		minPoints := defaultMinPoints
+		if _, ok := query["min_points"]; ok {
+			if minPoints, err = intParam(query, "min_points"); err != nil || minPoints < 1 {
+				http.Error(w, "Invalid min_points value", http.StatusBadRequest)
+				return
+			}
+		}
+		format := query.Get("format")
+		if format != "" && format != "json" && format != "geojson" {
+			http.Error(w, "Invalid format, expected json or geojson", http.StatusBadRequest)
+			return
+		}
+
+		var events []Earthquake
+		err = streamEarthquakes(r.Context(), db, filter, func(e Earthquake) error {
+			if len(events) == maxDBSCANEarthquakes {
+				return errTooManyEarthquakes
+			}
+			events = append(events, e)
+			return nil
+		})
+		if err == errTooManyEarthquakes {
+			http.Error(w, fmt.Sprintf("%s, at most %d are clustered", err, maxDBSCANEarthquakes), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println("Error fetching earthquakes to cluster:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		labels := dbscan(events, epsKm, epsDays, minPoints)
+		var members [][]Earthquake
+		noise := 0
+		for i, label := range labels {
+			if label < 0 {
+				noise++
+				continue
+			}
+			for len(members) <= label {
+				members = append(members, nil)
+			}
+			members[label] = append(members[label], events[i])
+		}
+		swarms := make([]swarm, 0, len(members))
+		for id, m := range members {
+			swarms = append(swarms, summarizeSwarm(id, m))
+		}
+
+		if format == "geojson" {
+			features := make([]geoJSONFeature, 0, len(swarms))
+			for _, s := range swarms {
+				// Collinear or coincident epicentres have no area to outline
+				geometry := geoJSONGeometry{Type: "Polygon", Coordinates: [][][2]float64{s.Hull}}
+				switch {
+				case len(s.Hull) == 1:
+					geometry = geoJSONGeometry{Type: "Point", Coordinates: s.Hull[0]}
+				case len(s.Hull) < 4:
+					geometry = geoJSONGeometry{Type: "LineString", Coordinates: s.Hull}
+				}
+				features = append(features, geoJSONFeature{
+					Type:     "Feature",
+					Id:       fmt.Sprint(s.Id),
+					Geometry: geometry,
+					Properties: map[string]interface{}{
+						"count":         s.Count,
+						"latitude":      s.Latitude,
+						"longitude":     s.Longitude,
+						"start":         s.Start,
+						"end":           s.End,
+						"max_magnitude": s.MaxMagnitude,
+						"mean_depth":    s.MeanDepth,
+						"energy_joules": s.EnergyJoules,
+						"members":       s.Members,
+					},
+				})
+			}
+			w.Header().Set("Content-Type", "application/geo+json")
+			json.NewEncoder(w).Encode(struct {
+				Type     string           `json:"type"`
+				Features []geoJSONFeature `json:"features"`
+			}{"FeatureCollection", features})
+			return
+		}
+
+		json.NewEncoder(w).Encode(struct {
+			EpsKm     float64 `json:"eps_km"`
+			EpsDays   float64 `json:"eps_days"`
+			MinPoints int     `json:"min_points"`
+			Count     int     `json:"count"`
+			Noise     int     `json:"noise"`
+			Clusters  []swarm `json:"clusters"`
+		}{epsKm, epsDays, minPoints, len(events), noise, swarms})
+	}
+}
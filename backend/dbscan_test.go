@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// quakeAt places an earthquake km north of the equator at the prime
+// meridian, days into 2024
+func quakeAt(kmNorth, days float64) Earthquake {
+	return Earthquake{
+		Latitude: kmNorth / kmPerDegree,
+		Time:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(days * 24 * float64(time.Hour))),
+	}
+}
+
+func TestDBSCANClustersAndNoise(t *testing.T) {
+	var events []Earthquake
+	for i := 0; i < 6; i++ {
+		events = append(events, quakeAt(float64(i)*0.2, 0), quakeAt(200+float64(i)*0.2, 0))
+	}
+	events = append(events, quakeAt(100, 0))
+
+	want := []int{0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, -1}
+	if got := dbscan(events, 10, 0, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("dbscan = %v, want %v", got, want)
+	}
+}
+
+func TestDBSCANBorderPoints(t *testing.T) {
+	events := []Earthquake{
+		// Visited first, when it has too few neighbours to start a cluster
+		quakeAt(13, 0),
+		quakeAt(0, 0), quakeAt(1, 0), quakeAt(2, 0), quakeAt(3, 0), quakeAt(4, 0),
+		quakeAt(-8, 0),
+		quakeAt(25, 0),
+	}
+	want := []int{0, 0, 0, 0, 0, 0, 0, -1}
+	if got := dbscan(events, 10, 0, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("dbscan = %v, want %v", got, want)
+	}
+}
+
+func TestDBSCANTimeScale(t *testing.T) {
+	var events []Earthquake
+	for i := 0; i < 6; i++ {
+		events = append(events, quakeAt(float64(i), float64(i)*30))
+	}
+
+	if got, want := dbscan(events, 10, 7, 5), []int{-1, -1, -1, -1, -1, -1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dbscan a month apart with 7 day eps = %v, want %v", got, want)
+	}
+	if got, want := dbscan(events, 10, 0, 5), []int{0, 0, 0, 0, 0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dbscan ignoring time = %v, want %v", got, want)
+	}
+}
+
+func TestDBSCANDenseSwarm(t *testing.T) {
+	// Every event neighbours every other, the worst case for the queue
+	events := make([]Earthquake, 500)
+	for i := range events {
+		events[i] = quakeAt(float64(i%10)*0.01, float64(i%7)*0.1)
+	}
+	for i, label := range dbscan(events, 10, 7, 5) {
+		if label != 0 {
+			t.Fatalf("event %d labelled %d, want 0", i, label)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Roles assigned by declustering. Events outside any cluster are mainshocks
+// without a cluster_id.
+const (
+	roleMainshock  = "mainshock"
+	roleForeshock  = "foreshock"
+	roleAftershock = "aftershock"
+)
+
+// Reasenberg (1985) parameters, the defaults of his CLUSTER2000 program
+const (
+	reasenbergTauMin = 1.0  // look-ahead time in days for unclustered events
+	reasenbergTauMax = 10.0 // maximum look-ahead time in days within clusters
+	reasenbergP1     = 0.99 // confidence of observing the next event in the sequence
+	reasenbergXK     = 0.5  // increase of the lower magnitude cutoff within clusters
+	reasenbergXMeff  = 1.5  // effective lower magnitude cutoff of the catalog
+	reasenbergRFact  = 10.0 // interaction radius in crack radii
+)
+
+// declusterEvent is the part of an earthquake declustering looks at
+type declusterEvent struct {
+	id        int
+	time      time.Time
+	latitude  float64
+	longitude float64
+	magnitude float64
+}
+
+func (e declusterEvent) distanceKm(o declusterEvent) float64 {
+	return haversineKm(e.latitude, e.longitude, o.latitude, o.longitude)
+}
+
+func daysBetween(a, b time.Time) float64 {
+	return b.Sub(a).Hours() / 24
+}
+
+// gardnerKnopoffWindow is the space and time window within which events are
+// dependent on a mainshock of magnitude m (Gardner & Knopoff, 1974)
+func gardnerKnopoffWindow(m float64) (km, days float64) {
+	km = math.Pow(10, 0.1238*m+0.983)
+	if m >= 6.5 {
+		days = math.Pow(10, 0.032*m+2.7389)
+	} else {
+		days = math.Pow(10, 0.5409*m-0.547)
+	}
+	return km, days
+}
+
+// declusterGardnerKnopoff groups events into clusters by window. Events are
+// taken in decreasing magnitude order; each one not yet in a cluster claims
+// the unclaimed smaller events within its window. Events must be in time
+// order. The result maps each event index to the index of its mainshock, or
+// -1 for events that belong to no cluster.
+func declusterGardnerKnopoff(events []declusterEvent) []int {
+	mainshock := make([]int, len(events))
+	for i := range mainshock {
+		mainshock[i] = -1
+	}
+
+	byMagnitude := make([]int, len(events))
+	for i := range byMagnitude {
+		byMagnitude[i] = i
+	}
+	sort.SliceStable(byMagnitude, func(a, b int) bool {
+		return events[byMagnitude[a]].magnitude > events[byMagnitude[b]].magnitude
+	})
+
+	for _, i := range byMagnitude {
+		if mainshock[i] != -1 {
+			continue
+		}
+		km, days := gardnerKnopoffWindow(events[i].magnitude)
+		window := time.Duration(days * 24 * float64(time.Hour))
+
+		// Events are in time order, so scan out from the first one in the window
+		start := sort.Search(len(events), func(j int) bool {
+			return !events[j].time.Before(events[i].time.Add(-window))
+		})
+		for j := start; j < len(events) && !events[j].time.After(events[i].time.Add(window)); j++ {
+			if j == i || mainshock[j] != -1 || events[j].magnitude > events[i].magnitude {
+				continue
+			}
+			if events[i].distanceKm(events[j]) <= km {
+				mainshock[j] = i
+				mainshock[i] = i
+			}
+		}
+	}
+	return mainshock
+}
+
+// crackRadiusKm is the source dimension of an earthquake of magnitude m used
+// by Reasenberg (1985), log10 r = 0.4M - 1.96
+func crackRadiusKm(m float64) float64 {
+	return math.Pow(10, 0.4*m-1.96)
+}
+
+// declusterReasenberg links events into clusters whenever a later event falls
+// within the interaction zone of an earlier one (Reasenberg, 1985). The
+// interaction radius grows with the event's and its cluster's largest
+// magnitude; the look-ahead time follows Omori's law from the cluster's
+// largest event. Events must be in time order. The result maps each event
+// index to the index of its cluster's largest event, or -1 for events that
+// belong to no cluster.
+func declusterReasenberg(events []declusterEvent) []int {
+	cluster := make([]int, len(events)) // cluster number, -1 for none
+	for i := range cluster {
+		cluster[i] = -1
+	}
+	var largest []int   // index of each cluster's largest event
+	var members [][]int // events of each cluster
+
+	join := func(c, j int) {
+		cluster[j] = c
+		members[c] = append(members[c], j)
+		if events[j].magnitude > events[largest[c]].magnitude {
+			largest[c] = j
+		}
+	}
+
+	for i := range events {
+		tau := reasenbergTauMin
+		mMax := events[i].magnitude
+		if c := cluster[i]; c != -1 {
+			big := events[largest[c]]
+			mMax = big.magnitude
+			// Omori's law gives the time within which the next event is
+			// expected with probability P1, given the events above the
+			// cluster's raised magnitude cutoff
+			deltaM := (1-reasenbergXK)*big.magnitude - reasenbergXMeff
+			if t := daysBetween(big.time, events[i].time); t > 0 {
+				tau = -math.Log(1-reasenbergP1) * t / math.Pow(10, (deltaM-1)*2/3)
+				tau = math.Max(reasenbergTauMin, math.Min(reasenbergTauMax, tau))
+			}
+		}
+		radius := reasenbergRFact*crackRadiusKm(mMax) + crackRadiusKm(events[i].magnitude)
+
+		for j := i + 1; j < len(events) && daysBetween(events[i].time, events[j].time) <= tau; j++ {
+			if events[i].distanceKm(events[j]) > radius {
+				continue
+			}
+			ci, cj := cluster[i], cluster[j]
+			switch {
+			case ci == -1 && cj == -1:
+				largest = append(largest, i)
+				members = append(members, nil)
+				ci = len(largest) - 1
+				join(ci, i)
+				join(ci, j)
+			case ci == -1:
+				join(cj, i)
+			case cj == -1:
+				join(ci, j)
+			case ci != cj:
+				// Merge the later cluster into the earlier one
+				for _, k := range members[cj] {
+					join(ci, k)
+				}
+				members[cj] = nil
+			}
+		}
+	}
+
+	mainshock := make([]int, len(events))
+	for i, c := range cluster {
+		mainshock[i] = -1
+		if c != -1 {
+			mainshock[i] = largest[c]
+		}
+	}
+	return mainshock
+}
+
+// declusterMethods maps method names to their implementations
+var declusterMethods = map[string]func([]declusterEvent) []int{
+	"gardner-knopoff": declusterGardnerKnopoff,
+	"reasenberg":      declusterReasenberg,
+}
+
+// declusterEarthquakes runs a declustering method over the whole earthquakes
+// table and stores each event's cluster_id, the id of its cluster's
+// mainshock, and its role. It returns the number of clusters found.
+func declusterEarthquakes(db *sql.DB, method string) (int, error) {
+	decluster, ok := declusterMethods[method]
+	if !ok {
+		return 0, fmt.Errorf("unknown declustering method %q: expected gardner-knopoff or reasenberg", method)
+	}
+
+	rows, err := db.Query(`
+	SELECT id, time, latitude, longitude, magnitude
+	FROM earthquakes
+	WHERE time IS NOT NULL AND latitude IS NOT NULL AND longitude IS NOT NULL AND magnitude IS NOT NULL
+	ORDER BY time, id`)
+	if err != nil {
+		return 0, err
+	}
+	var events []declusterEvent
+	for rows.Next() {
+		var e declusterEvent
+		if err := rows.Scan(&e.id, &e.time, &e.latitude, &e.longitude, &e.magnitude); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	mainshock := decluster(events)
+
+	var ids, clusterIDs []int64
+	var roles []string
+	clusters := 0
+	for i, m := range mainshock {
+		if m == -1 {
+			continue
+		}
+		role := roleAftershock
+		switch {
+		case m == i:
+			role = roleMainshock
+			clusters++
+		case events[i].time.Before(events[m].time):
+			role = roleForeshock
+		}
+		ids = append(ids, int64(events[i].id))
+		clusterIDs = append(clusterIDs, int64(events[m].id))
+		roles = append(roles, role)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE earthquakes SET cluster_id = NULL, role = $1", roleMainshock); err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`
+	UPDATE earthquakes SET cluster_id = c.cluster_id, role = c.role
+	FROM unnest($1::int[], $2::int[], $3::text[]) AS c(id, cluster_id, role)
+	WHERE earthquakes.id = c.id`, pq.Array(ids), pq.Array(clusterIDs), pq.Array(roles))
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	log.Printf("Declustered %d earthquakes with %s: %d clusters, %d dependent events",
+		len(events), method, clusters, len(ids)-clusters)
+	return clusters, nil
+}
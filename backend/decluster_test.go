@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// seqEvent places an event days after a sequence's origin and km north of
+// its epicentre
+type seqEvent struct{ days, kmNorth, magnitude float64 }
+
+// sequence builds time-ordered declustering events around a common epicentre
+func sequence(events ...seqEvent) []declusterEvent {
+	origin := time.Date(2019, 7, 6, 3, 19, 53, 0, time.UTC)
+	var out []declusterEvent
+	for i, e := range events {
+		out = append(out, declusterEvent{
+			id:        i + 1,
+			time:      origin.Add(time.Duration(e.days * 24 * float64(time.Hour))),
+			latitude:  35.77 + e.kmNorth/kmPerDegree,
+			longitude: -117.6,
+			magnitude: e.magnitude,
+		})
+	}
+	return out
+}
+
+func TestDeclusterGardnerKnopoff(t *testing.T) {
+	// An M6 has a window of about 53 km and 499 days
+	events := sequence(
+		seqEvent{-2, 5, 3.0},   // foreshock
+		seqEvent{-1, 500, 2.5}, // too far
+		seqEvent{0, 0, 6.0},    // mainshock
+		seqEvent{1, -10, 4.5},  // aftershock
+		seqEvent{30, -40, 3.5}, // aftershock
+		seqEvent{30, 70, 3.5},  // outside the distance window
+		seqEvent{600, 1, 3.0},  // outside the time window
+	)
+	want := []int{2, -1, 2, 2, 2, -1, -1}
+	if got := declusterGardnerKnopoff(events); !reflect.DeepEqual(got, want) {
+		t.Errorf("declusterGardnerKnopoff = %v, want %v", got, want)
+	}
+}
+
+func TestDeclusterReasenberg(t *testing.T) {
+	events := sequence(
+		seqEvent{0, 0, 5.0},     // mainshock
+		seqEvent{0.5, 5, 3.0},   // within a day and the M5's interaction radius
+		seqEvent{2.5, -5, 3.0},  // linked through the Omori look-ahead of the event before
+		seqEvent{20, 0, 3.0},    // past the longest look-ahead
+		seqEvent{30, 1000, 4.0}, // a separate pair
+		seqEvent{30.2, 1001, 3.5},
+		seqEvent{40, 0, 4.0}, // isolated
+	)
+	want := []int{0, 0, 0, -1, 4, 4, -1}
+	if got := declusterReasenberg(events); !reflect.DeepEqual(got, want) {
+		t.Errorf("declusterReasenberg = %v, want %v", got, want)
+	}
+
+	// A cluster's mainshock is its largest event, even when it comes later
+	events = sequence(seqEvent{0, 0, 3.0}, seqEvent{0.1, 1, 5.0})
+	if got, want := declusterReasenberg(events), []int{1, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("declusterReasenberg of a foreshock = %v, want %v", got, want)
+	}
+}
+
+func TestDeclusterEmpty(t *testing.T) {
+	for name, decluster := range declusterMethods {
+		if got := decluster(nil); len(got) != 0 {
+			t.Errorf("%s of no events = %v", name, got)
+		}
+	}
+}
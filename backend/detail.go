@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Defaults for the nearby events of an earthquake's detail view
+const (
+	defaultNearbyLimit    = 10
+	maxNearbyLimit        = 100
+	defaultNearbyRadiusKm = 100.0
+	defaultNearbyDays     = 30.0
+)
+
+// joulesPerTonTNT converts energy to its TNT equivalent
+const joulesPerTonTNT = 4.184e9
+
+// earthquakeDetail is an earthquake with its surroundings and derived values
+type earthquakeDetail struct {
+	Earthquake Earthquake `json:"earthquake"`
+
+	// LocalTime is the origin time in the nautical time zone of the
+	// epicentre, one hour per 15 degrees of longitude
+	LocalTime    string  `json:"local_time"`
+	UTCOffset    string  `json:"utc_offset"`
+	EnergyJoules float64 `json:"energy_joules"`
+	EnergyTNT    float64 `json:"energy_tnt_tons"`
+
+	Nearby   []Earthquake `json:"nearby"`
+	Sequence []Earthquake `json:"sequence"`
+}
+
+// nauticalZone is the fixed offset time zone for a longitude
+func nauticalZone(lon float64) *time.Location {
+	hours := int(math.Round(normalizeLongitude(lon) / 15))
+	name := "UTC"
+	if hours != 0 {
+		name = fmt.Sprintf("UTC%+03d:00", hours)
+	}
+	return time.FixedZone(name, hours*3600)
+}
+
+// nearbyEarthquakes returns up to limit other earthquakes within radiusKm and
+// days of e, nearest first
+func nearbyEarthquakes(r *http.Request, db *sql.DB, e Earthquake, limit int, radiusKm, days float64) ([]Earthquake, error) {
+	window := time.Duration(days * 24 * float64(time.Hour))
+	start, end := e.Time.Add(-window), e.Time.Add(window)
+	f := earthquakeFilter{
+		TimeStart:   &start,
+		TimeEnd:     &end,
+		Latitude:    &e.Latitude,
+		Longitude:   &e.Longitude,
+		MaxRadiusKm: &radiusKm,
+	}
+
+	nearby := []Earthquake{}
+	err := streamEarthquakes(r.Context(), db, f, func(n Earthquake) error {
+		if n.Id != e.Id {
+			n.setDistanceFrom(e.Latitude, e.Longitude)
+			nearby = append(nearby, n)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(nearby, func(i, j int) bool { return *nearby[i].DistanceKm < *nearby[j].DistanceKm })
+	if len(nearby) > limit {
+		nearby = nearby[:limit]
+	}
+	return nearby, nil
+}
+
+// findEarthquake looks an earthquake up by database id, or by event id if id
+// is not numeric, returning sql.ErrNoRows if there is none
+func findEarthquake(r *http.Request, db *sql.DB, id string) (Earthquake, error) {
+	var f earthquakeFilter
+	if n, err := strconv.Atoi(id); err == nil && n > 0 {
+		f.Id = n
+	} else {
+		f.EventId = id
+	}
+	found, err := queryEarthquakes(r.Context(), db, f)
+	if err != nil {
+		return Earthquake{}, err
+	}
+	if len(found) == 0 {
+		return Earthquake{}, sql.ErrNoRows
+	}
+	return found[0], nil
+}
+
+// get an earthquake by database id or event id, with the nearest events in
+// space and time and the declustered sequence it belongs to
+func getEarthquake(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := getUserIDFromContext(r.Context()); err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		query := r.URL.Query()
+		limit := defaultNearbyLimit
+		if _, ok := query["nearby_limit"]; ok {
+			v, err := intParam(query, "nearby_limit")
+			if err != nil || v > maxNearbyLimit {
+				http.Error(w, fmt.Sprintf("Invalid nearby_limit value, expected at most %d", maxNearbyLimit), http.StatusBadRequest)
+				return
+			}
+			limit = v
+		}
+		radiusKm, days := defaultNearbyRadiusKm, defaultNearbyDays
+		for _, p := range []struct {
+			name string
+			dst  *float64
+		}{{"nearby_radius_km", &radiusKm}, {"nearby_days", &days}} {
+			v, err := floatParam(query, p.name)
+			if err != nil || (v != nil && *v < 0) {
+				http.Error(w, "Invalid "+p.name+" value", http.StatusBadRequest)
+				return
+			}
+			if v != nil {
+				*p.dst = *v
+			}
+		}
+
+		e, err := findEarthquake(r, db, mux.Vars(r)["id"])
+		if err == sql.ErrNoRows {
+			http.Error(w, "Earthquake not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Error fetching earthquake:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		energy := seismicEnergyJoules(e.Magnitude)
+		local := e.Time.In(nauticalZone(e.Longitude))
+		detail := earthquakeDetail{
+			Earthquake:   e,
+			LocalTime:    local.Format(time.RFC3339),
+			UTCOffset:    local.Format("-07:00"),
+			EnergyJoules: energy,
+			EnergyTNT:    energy / joulesPerTonTNT,
+			Sequence:     []Earthquake{},
+		}
+
+		if limit > 0 {
+			if detail.Nearby, err = nearbyEarthquakes(r, db, e, limit, radiusKm, days); err != nil {
+				log.Println("Error fetching nearby earthquakes:", err)
+				http.Error(w, "Database query error", http.StatusInternalServerError)
+				return
+			}
+		} else {
+			detail.Nearby = []Earthquake{}
+		}
+
+		if e.ClusterId != nil {
+			sequence := earthquakeFilter{ClusterId: e.ClusterId, OrderBy: "time"}
+			if detail.Sequence, err = queryEarthquakes(r.Context(), db, sequence); err != nil {
+				log.Println("Error fetching earthquake sequence:", err)
+				http.Error(w, "Database query error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		json.NewEncoder(w).Encode(detail)
+	}
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// earthquakeFilter holds the search criteria shared by every endpoint that
+// queries the earthquakes table. Nil fields are not filtered on.
+type earthquakeFilter struct {
+	TimeStart    *time.Time
+	TimeEnd      *time.Time
+	DepthMin     *float64
+	DepthMax     *float64
+	MagnitudeMin *float64
+	MagnitudeMax *float64
+	LongitudeMin *float64
+	LongitudeMax *float64
+	LatitudeMin  *float64
+	LatitudeMax  *float64
+
+	// Circle search around Latitude/Longitude, distances in km
+	Latitude    *float64
+	Longitude   *float64
+	MinRadiusKm *float64
+	MaxRadiusKm *float64
+
+	// Id and EventId select a single event; ClusterId the events of a cluster
+	Id        int
+	EventId   string
+	ClusterId *int
+
+	// Declustered keeps mainshocks and events outside any cluster
+	Declustered bool
+
+	// Area is evaluated in Go after a bounding box prefilter in SQL
+	Area *areaFilter
+
+	// OrderBy is a column name, empty for the database's natural order
+	OrderBy    string
+	Descending bool
+	Limit      int
+	Offset     int
+
+	// After continues a keyset-paginated listing past the cursor's row
+	After *earthquakeCursor
+}
+
+// earthquakeCursor marks the last row of a page by its sort value and id
+type earthquakeCursor struct {
+	OrderBy string
+	Value   interface{}
+	Id      int
+}
+
+// orderColumns are the columns getEarthquakes can sort by
+var orderColumns = map[string]bool{"time": true, "magnitude": true, "depth": true}
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 10000
+)
+
+// cursorFor encodes the position of e in a listing sorted by orderBy
+func cursorFor(orderBy string, e Earthquake) string {
+	var value string
+	switch orderBy {
+	case "time":
+		value = e.Time.UTC().Format(time.RFC3339Nano)
+	case "magnitude":
+		value = strconv.FormatFloat(e.Magnitude, 'g', -1, 64)
+	case "depth":
+		value = strconv.FormatFloat(e.Depth, 'g', -1, 64)
+	}
+	raw := orderBy + "|" + value + "|" + strconv.Itoa(e.Id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseCursor(s string) (*earthquakeCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 || !orderColumns[parts[0]] {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+
+	c := &earthquakeCursor{OrderBy: parts[0]}
+	if c.Id, err = strconv.Atoi(parts[2]); err != nil {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	if c.OrderBy == "time" {
+		c.Value, err = time.Parse(time.RFC3339Nano, parts[1])
+	} else {
+		var v float64
+		if v, err = strconv.ParseFloat(parts[1], 64); err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			err = fmt.Errorf("non-finite cursor value")
+		}
+		c.Value = v
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	return c, nil
+}
+
+// parsePagination reads limit, cursor, order_by and direction. It reports
+// whether the caller asked for a page rather than the full result set.
+func parsePagination(query url.Values, f *earthquakeFilter) (bool, error) {
+	f.OrderBy, f.Descending = "time", true
+	if orderBy := query.Get("order_by"); orderBy != "" {
+		if !orderColumns[orderBy] {
+			return false, fmt.Errorf("Invalid order_by, expected time, magnitude or depth")
+		}
+		f.OrderBy = orderBy
+	}
+	switch query.Get("direction") {
+	case "", "desc":
+	case "asc":
+		f.Descending = false
+	default:
+		return false, fmt.Errorf("Invalid direction, expected asc or desc")
+	}
+
+	_, hasLimit := query["limit"]
+	cursor := query.Get("cursor")
+	if !hasLimit && cursor == "" {
+		return false, nil
+	}
+
+	limit, err := intParam(query, "limit")
+	if err != nil {
+		return false, err
+	}
+	if !hasLimit || limit == 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	f.Limit = limit
+
+	if cursor != "" {
+		if f.After, err = parseCursor(cursor); err != nil {
+			return false, err
+		}
+		if f.After.OrderBy != f.OrderBy {
+			return false, fmt.Errorf("Cursor does not match order_by")
+		}
+	}
+	return true, nil
+}
+
+// parseEarthquakeFilter reads the filter parameters accepted by getEarthquakes
+func parseEarthquakeFilter(query url.Values) (earthquakeFilter, error) {
+	var f earthquakeFilter
+	var err error
+
+	if f.TimeStart, err = timeParam(query, "time_start"); err != nil {
+		return f, err
+	}
+	if f.TimeEnd, err = timeParam(query, "time_end"); err != nil {
+		return f, err
+	}
+
+	floats := []struct {
+		name string
+		dst  **float64
+	}{
+		{"depth_min", &f.DepthMin},
+		{"depth_max", &f.DepthMax},
+		{"magnitude_min", &f.MagnitudeMin},
+		{"magnitude_max", &f.MagnitudeMax},
+		{"longitude_min", &f.LongitudeMin},
+		{"longitude_max", &f.LongitudeMax},
+		{"latitude_min", &f.LatitudeMin},
+		{"latitude_max", &f.LatitudeMax},
+		{"lat", &f.Latitude},
+		{"lon", &f.Longitude},
+		{"min_radius_km", &f.MinRadiusKm},
+		{"max_radius_km", &f.MaxRadiusKm},
+	}
+	for _, p := range floats {
+		if *p.dst, err = floatParam(query, p.name); err != nil {
+			return f, err
+		}
+	}
+
+	if v := query.Get("declustered"); v != "" {
+		if f.Declustered, err = strconv.ParseBool(v); err != nil {
+			return f, fmt.Errorf("Invalid declustered value")
+		}
+	}
+
+	if f.MinRadiusKm != nil || f.MaxRadiusKm != nil {
+		if f.Latitude == nil || f.Longitude == nil {
+			return f, fmt.Errorf("Radius search requires lat and lon")
+		}
+	}
+	if f.Latitude != nil && (*f.Latitude < -90 || *f.Latitude > 90) {
+		return f, fmt.Errorf("Invalid lat value")
+	}
+	if f.Longitude != nil && (*f.Longitude < -180 || *f.Longitude > 180) {
+		return f, fmt.Errorf("Invalid lon value")
+	}
+
+	return f, nil
+}
+
+// requestFilter reads the getEarthquakes filter parameters and search area
+// of a request, returning the status to respond with if they are invalid
+func requestFilter(db *sql.DB, r *http.Request, userID string) (earthquakeFilter, int, error) {
+	f, err := parseEarthquakeFilter(r.URL.Query())
+	if err != nil {
+		return f, http.StatusBadRequest, err
+	}
+	area, status, err := requestArea(db, r, userID)
+	if err != nil {
+		return f, status, fmt.Errorf("Invalid search area: %v", err)
+	}
+	f.Area = area
+	return f, 0, nil
+}
+
+func timeParam(query url.Values, name string) (*time.Time, error) {
+	val, ok := query[name]
+	if !ok {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, val[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s format", name)
+	}
+	return &t, nil
+}
+
+func floatParam(query url.Values, name string) (*float64, error) {
+	val, ok := query[name]
+	if !ok {
+		return nil, nil
+	}
+	// ParseFloat accepts NaN and Inf, which no parameter has a use for
+	v, err := strconv.ParseFloat(val[0], 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Errorf("Invalid %s value", name)
+	}
+	return &v, nil
+}
+
+func intParam(query url.Values, name string) (int, error) {
+	val, ok := query[name]
+	if !ok {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(val[0])
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("Invalid %s value", name)
+	}
+	return v, nil
+}
+
+// where builds the SQL conditions and positional arguments for the filter
+func (f earthquakeFilter) where() ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if f.TimeStart != nil {
+		conditions = append(conditions, "time >= "+arg(*f.TimeStart))
+	}
+	if f.TimeEnd != nil {
+		conditions = append(conditions, "time <= "+arg(*f.TimeEnd))
+	}
+
+	bounds := []struct {
+		cond string
+		val  *float64
+	}{
+		{"depth >= ", f.DepthMin},
+		{"depth <= ", f.DepthMax},
+		{"magnitude >= ", f.MagnitudeMin},
+		{"magnitude <= ", f.MagnitudeMax},
+		{"latitude >= ", f.LatitudeMin},
+		{"latitude <= ", f.LatitudeMax},
+	}
+	for _, b := range bounds {
+		if b.val != nil {
+			conditions = append(conditions, b.cond+arg(*b.val))
+		}
+	}
+
+	// A box whose minimum longitude is east of its maximum crosses the antimeridian
+	longitudeRange := func(min, max float64) {
+		min, max = normalizeLongitudeRange(min, max)
+		if min <= max {
+			if min > -180 || max < 180 {
+				conditions = append(conditions, "longitude BETWEEN "+arg(min)+" AND "+arg(max))
+			}
+		} else {
+			conditions = append(conditions, "(longitude >= "+arg(min)+" OR longitude <= "+arg(max)+")")
+		}
+	}
+	switch {
+	case f.LongitudeMin != nil && f.LongitudeMax != nil:
+		longitudeRange(*f.LongitudeMin, *f.LongitudeMax)
+	case f.LongitudeMin != nil:
+		conditions = append(conditions, "longitude >= "+arg(normalizeLongitude(*f.LongitudeMin)))
+	case f.LongitudeMax != nil:
+		conditions = append(conditions, "longitude <= "+arg(normalizeLongitude(*f.LongitudeMax)))
+	}
+
+	if f.Latitude != nil && f.Longitude != nil && (f.MinRadiusKm != nil || f.MaxRadiusKm != nil) {
+		distance := distanceSQL(arg(*f.Latitude), arg(*f.Longitude))
+		if f.MinRadiusKm != nil {
+			conditions = append(conditions, distance+" >= "+arg(*f.MinRadiusKm))
+		}
+		if f.MaxRadiusKm != nil {
+			conditions = append(conditions, distance+" <= "+arg(*f.MaxRadiusKm))
+		}
+	}
+
+	if f.Id != 0 {
+		conditions = append(conditions, "id = "+arg(f.Id))
+	}
+	if f.EventId != "" {
+		conditions = append(conditions, "event_id = "+arg(f.EventId))
+	}
+	if f.ClusterId != nil {
+		conditions = append(conditions, "cluster_id = "+arg(*f.ClusterId))
+	}
+
+	if f.Declustered {
+		// Events added since the last declustering run have no role yet
+		conditions = append(conditions, "COALESCE(role, "+arg(roleMainshock)+") = "+arg(roleMainshock))
+	}
+
+	if f.Area != nil {
+		minLon, minLat, maxLon, maxLat := f.Area.bbox()
+		longitudeRange(minLon, maxLon)
+		conditions = append(conditions, "latitude BETWEEN "+arg(minLat)+" AND "+arg(maxLat))
+	}
+
+	if f.After != nil && f.After.OrderBy == f.OrderBy {
+		cmp := " > "
+		if f.Descending {
+			cmp = " < "
+		}
+		conditions = append(conditions, "("+f.OrderBy+", id)"+cmp+"("+arg(f.After.Value)+", "+arg(f.After.Id)+")")
+	}
+
+	return conditions, args
+}
+
+// distanceSQL is the haversine great-circle distance in km from each row to
+// the point given by the lat and lon placeholders
+func distanceSQL(lat, lon string) string {
+	return fmt.Sprintf("(2 * %f * asin(LEAST(1, sqrt("+
+		"power(sin(radians(latitude - %s) / 2), 2) + "+
+		"cos(radians(%s)) * cos(radians(latitude)) * power(sin(radians(longitude - %s) / 2), 2)))))",
+		earthRadiusKm, lat, lat, lon)
+}
+
+const earthquakeColumns = "id, COALESCE(event_id, ''), time, latitude, longitude, depth, magnitude, COALESCE(magnitude_type, ''), place, alert, tsunami, url, cluster_id, COALESCE(role, '')"
+
+// setDistanceFrom fills in the great-circle distance and bearing from a point to e
+func (e *Earthquake) setDistanceFrom(lat, lon float64) {
+	distance := haversineKm(lat, lon, e.Latitude, e.Longitude)
+	bearing := bearingDegrees(lat, lon, e.Latitude, e.Longitude)
+	e.DistanceKm = &distance
+	e.Bearing = &bearing
+}
+
+func scanEarthquake(rows *sql.Rows) (Earthquake, error) {
+	var e Earthquake
+	var clusterID sql.NullInt64
+	err := rows.Scan(&e.Id, &e.EventId, &e.Time, &e.Latitude, &e.Longitude, &e.Depth, &e.Magnitude, &e.MagnitudeType, &e.Place, &e.Alert, &e.Tsunami, &e.URL, &clusterID, &e.Role)
+	if clusterID.Valid {
+		id := int(clusterID.Int64)
+		e.ClusterId = &id
+	}
+	return e, err
+}
+
+// streamEarthquakes runs the filter against the earthquakes table and calls
+// fn with each matching row as it is read. With an area filter, limit and
+// offset are applied to the rows inside the area. The query is abandoned when
+// ctx is cancelled or fn returns an error.
+func streamEarthquakes(ctx context.Context, db *sql.DB, f earthquakeFilter, fn func(Earthquake) error) error {
+	limit, offset := f.Limit, f.Offset
+	if f.Area != nil {
+		f.Limit, f.Offset = 0, 0
+	}
+	conditions, args := f.where()
+
+	queryString := "SELECT " + earthquakeColumns + " FROM earthquakes"
+	if len(conditions) > 0 {
+		queryString += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if f.OrderBy != "" {
+		direction := " ASC"
+		if f.Descending {
+			direction = " DESC"
+		}
+		queryString += " ORDER BY " + f.OrderBy + direction + ", id" + direction
+	}
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		queryString += " LIMIT $" + strconv.Itoa(len(args))
+	}
+	if f.Offset > 0 {
+		args = append(args, f.Offset)
+		queryString += " OFFSET $" + strconv.Itoa(len(args))
+	}
+
+	log.Println("Executing query:", queryString, "with args:", args)
+
+	rows, err := db.QueryContext(ctx, queryString, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		e, err := scanEarthquake(rows)
+		if err != nil {
+			log.Println("Error scanning row:", err)
+			continue
+		}
+		if f.Area != nil {
+			if !f.Area.contains(e.Longitude, e.Latitude) {
+				continue
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+		n++
+		if f.Area != nil && limit > 0 && n == limit {
+			break
+		}
+	}
+	return rows.Err()
+}
+
+// queryEarthquakes collects the results of a filter into a slice
+func queryEarthquakes(ctx context.Context, db *sql.DB, f earthquakeFilter) ([]Earthquake, error) {
+	earthquakes := []Earthquake{}
+	err := streamEarthquakes(ctx, db, f, func(e Earthquake) error {
+		earthquakes = append(earthquakes, e)
+		return nil
+	})
+	return earthquakes, err
+}
+
+// countEarthquakes counts every row matching the filter, ignoring paging
+func countEarthquakes(db *sql.DB, f earthquakeFilter) (int, error) {
+	f.After = nil
+	conditions, args := f.where()
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if f.Area == nil {
+		err := db.QueryRow("SELECT COUNT(*) FROM earthquakes"+where, args...).Scan(&total)
+		return total, err
+	}
+
+	rows, err := db.Query("SELECT longitude, latitude FROM earthquakes"+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var lon, lat float64
+		if err := rows.Scan(&lon, &lat); err != nil {
+			return 0, err
+		}
+		if f.Area.contains(lon, lat) {
+			total++
+		}
+	}
+	return total, rows.Err()
+}
+
+// earthquakePage is the response body of a paginated getEarthquakes request
+type earthquakePage struct {
+	Earthquakes []Earthquake `json:"earthquakes"`
+	NextCursor  string       `json:"next_cursor,omitempty"`
+	Total       int          `json:"total"`
+}
+
+// negotiateFormat picks the response format from the format parameter,
+// falling back to the Accept header
+func negotiateFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "json", "quakeml", "geojson", "csv", "kml", "ndjson":
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("Invalid format, expected json, geojson, quakeml, csv, kml or ndjson")
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/geo+json") {
+		return "geojson", nil
+	}
+	return "json", nil
+}
+
+func getEarthquakes(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			log.Println("Unauthorized request")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		log.Println("Fetching earthquakes for user ID:", userID)
+
+		// Parse query parameters
+		query := r.URL.Query()
+
+		format, err := negotiateFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter, status, err := requestFilter(db, r, userID)
+		if err != nil {
+			log.Println("Invalid earthquake filter:", err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		paginated, err := parsePagination(query, &filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		opts := encoderOptions{
+			withDistance: filter.Latitude != nil && filter.Longitude != nil,
+			geojson:      geoJSONMetadata{URL: r.URL.String(), Title: "Earthquakes"},
+		}
+
+		if !paginated {
+			enc := newEarthquakeEncoder(w, format, opts)
+			if opts.withDistance {
+				enc = &distanceEncoder{earthquakeEncoder: enc, latitude: *filter.Latitude, longitude: *filter.Longitude}
+			}
+			n, err := streamEarthquakeResponse(r.Context(), w, db, filter, enc, func() { setFormatHeaders(w, format) })
+			if err != nil {
+				if n == 0 {
+					log.Println("Error executing query:", err)
+					http.Error(w, "Database query error", http.StatusInternalServerError)
+					return
+				}
+				log.Println("Stopped streaming earthquakes after", n, "rows:", err)
+				return
+			}
+			if n == 0 {
+				setFormatHeaders(w, format)
+				err = encodeAll(enc, nil)
+			} else {
+				err = enc.end()
+			}
+			if err != nil {
+				log.Println("Error writing", format, "response:", err)
+			}
+			log.Println("Streamed", n, "earthquakes")
+			return
+		}
+
+		// Fetch one extra row to learn whether another page follows
+		pageSize := filter.Limit
+		filter.Limit++
+
+		earthquakes, err := queryEarthquakes(r.Context(), db, filter)
+		if err != nil {
+			log.Println("Error executing query:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Println("Retrieved", len(earthquakes), "earthquakes")
+
+		// Report where each earthquake lies relative to the search point
+		if opts.withDistance {
+			for i := range earthquakes {
+				earthquakes[i].setDistanceFrom(*filter.Latitude, *filter.Longitude)
+			}
+		}
+
+		var page earthquakePage
+		if len(earthquakes) > pageSize {
+			earthquakes = earthquakes[:pageSize]
+			page.NextCursor = cursorFor(filter.OrderBy, earthquakes[pageSize-1])
+		}
+		page.Earthquakes = earthquakes
+		if page.Total, err = countEarthquakes(db, filter); err != nil {
+			log.Println("Error counting earthquakes:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+		if page.NextCursor != "" {
+			w.Header().Set("X-Next-Cursor", page.NextCursor)
+		}
+
+		setFormatHeaders(w, format)
+		if format == "json" {
+			json.NewEncoder(w).Encode(page)
+			return
+		}
+		opts.geojson.Total = &page.Total
+		opts.geojson.NextCursor = page.NextCursor
+		if err := encodeAll(newEarthquakeEncoder(w, format, opts), earthquakes); err != nil {
+			log.Println("Error writing", format, "response:", err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWhereLongitudeBox(t *testing.T) {
+	tests := []struct {
+		name      string
+		min, max  string
+		condition string
+		args      []interface{}
+	}{
+		{"Aleutians", "170", "-170", "(longitude >= $1 OR longitude <= $2)", []interface{}{170.0, -170.0}},
+		{"western Aleutians", "172", "-172", "(longitude >= $1 OR longitude <= $2)", []interface{}{172.0, -172.0}},
+		{"Fiji", "177", "-178", "(longitude >= $1 OR longitude <= $2)", []interface{}{177.0, -178.0}},
+		{"New Zealand", "165", "180", "longitude BETWEEN $1 AND $2", []interface{}{165.0, 180.0}},
+		{"Aleutians past 180", "170", "190", "(longitude >= $1 OR longitude <= $2)", []interface{}{170.0, -170.0}},
+		{"both ends past 180", "190", "200", "longitude BETWEEN $1 AND $2", []interface{}{-170.0, -160.0}},
+		{"ordinary box", "-125", "-114", "longitude BETWEEN $1 AND $2", []interface{}{-125.0, -114.0}},
+		{"whole globe", "-180", "180", "", nil},
+		{"whole globe from 0", "0", "360", "", nil},
+	}
+	for _, tt := range tests {
+		f, err := parseEarthquakeFilter(url.Values{"longitude_min": {tt.min}, "longitude_max": {tt.max}})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		conditions, args := f.where()
+
+		var want []string
+		if tt.condition != "" {
+			want = []string{tt.condition}
+		}
+		if !reflect.DeepEqual(conditions, want) || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s: where() = %q %v, want %q %v", tt.name, conditions, args, want, tt.args)
+		}
+	}
+}
+
+func TestWhereLongitudeBoxMatches(t *testing.T) {
+	// matches evaluates the longitude condition where() builds for a box, as
+	// Postgres would, failing on any SQL it does not recognise
+	matches := func(minLon, maxLon, lon float64) bool {
+		f, err := parseEarthquakeFilter(url.Values{
+			"longitude_min": {strconv.FormatFloat(minLon, 'g', -1, 64)},
+			"longitude_max": {strconv.FormatFloat(maxLon, 'g', -1, 64)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conditions, args := f.where()
+		if len(conditions) == 0 {
+			return true
+		}
+		if len(conditions) != 1 || len(args) != 2 {
+			t.Fatalf("where() = %q %v, want one longitude condition", conditions, args)
+		}
+		min, max := args[0].(float64), args[1].(float64)
+		switch conditions[0] {
+		case "longitude BETWEEN $1 AND $2":
+			return lon >= min && lon <= max
+		case "(longitude >= $1 OR longitude <= $2)":
+			return lon >= min || lon <= max
+		}
+		t.Fatalf("unexpected condition %q", conditions[0])
+		return false
+	}
+
+	tests := []struct {
+		name     string
+		min, max float64
+		inside   []float64
+		outside  []float64
+	}{
+		{"Aleutians", 170, -170, []float64{170, 175.5, 180, -180, -179.9, -170}, []float64{169.9, -169.9, 0, -120}},
+		{"western Aleutians", 172, -172, []float64{172, 179, -179, -172}, []float64{171, -171, 0}},
+		{"Fiji", 177, -178, []float64{178.4, -179.1, -178}, []float64{176, -177, 0}},
+		{"New Zealand", 165, 180, []float64{165, 174.8, 180}, []float64{164.9, -179, 0}},
+		{"Aleutians past 180", 170, 190, []float64{179, -175}, []float64{-169, 160}},
+		{"whole globe", -180, 180, []float64{-180, 0, 180}, nil},
+		{"whole globe from 0", 0, 360, []float64{-180, -90, 0, 180}, nil},
+	}
+	for _, tt := range tests {
+		for _, lon := range tt.inside {
+			if !matches(tt.min, tt.max, lon) {
+				t.Errorf("%s: longitude %g should be inside %g to %g", tt.name, lon, tt.min, tt.max)
+			}
+		}
+		for _, lon := range tt.outside {
+			if matches(tt.min, tt.max, lon) {
+				t.Errorf("%s: longitude %g should be outside %g to %g", tt.name, lon, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestWhereOpenLongitudeBounds(t *testing.T) {
+	f, err := parseEarthquakeFilter(url.Values{"longitude_min": {"190"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conditions, args := f.where()
+	if !reflect.DeepEqual(conditions, []string{"longitude >= $1"}) || !reflect.DeepEqual(args, []interface{}{-170.0}) {
+		t.Errorf("where() = %q %v", conditions, args)
+	}
+}
+
+func TestFloatParamRejectsNonFinite(t *testing.T) {
+	for _, val := range []string{"NaN", "nan", "Inf", "-Inf", "+Infinity", "abc", ""} {
+		if v, err := floatParam(url.Values{"x": {val}}, "x"); err == nil {
+			t.Errorf("floatParam(%q) = %v, want an error", val, *v)
+		}
+	}
+	if v, err := floatParam(url.Values{"x": {"-12.5"}}, "x"); err != nil || *v != -12.5 {
+		t.Errorf("floatParam(-12.5) = %v, %v", v, err)
+	}
+	if v, err := floatParam(url.Values{}, "x"); err != nil || v != nil {
+		t.Errorf("floatParam of a missing parameter = %v, %v", v, err)
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	e := Earthquake{
+		Id:        4217,
+		Time:      time.Date(2023, 11, 14, 11, 50, 12, 345678000, time.UTC),
+		Magnitude: 4.7,
+		Depth:     35.4,
+	}
+	tests := []struct {
+		orderBy string
+		value   interface{}
+	}{
+		{"time", e.Time},
+		{"magnitude", 4.7},
+		{"depth", 35.4},
+	}
+	for _, tt := range tests {
+		c, err := parseCursor(cursorFor(tt.orderBy, e))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.orderBy, err)
+		}
+		if c.OrderBy != tt.orderBy || c.Id != e.Id || !reflect.DeepEqual(c.Value, tt.value) {
+			t.Errorf("%s: cursor decoded to %+v", tt.orderBy, c)
+		}
+	}
+}
+
+func TestParseCursorRejectsTampering(t *testing.T) {
+	encode := func(raw string) string { return base64.RawURLEncoding.EncodeToString([]byte(raw)) }
+	tests := map[string]string{
+		"not base64":            "!!not-base64!!",
+		"unknown column":        encode("place|Alaska|1"),
+		"SQL in the column":     encode("time; DROP TABLE earthquakes|2023-11-14T11:50:12Z|1"),
+		"missing id":            encode("time|2023-11-14T11:50:12Z"),
+		"extra field":           encode("time|2023-11-14T11:50:12Z|1|2"),
+		"non-numeric id":        encode("magnitude|4.7|one"),
+		"non-numeric magnitude": encode("magnitude|big|1"),
+		"NaN magnitude":         encode("magnitude|NaN|1"),
+		"infinite depth":        encode("depth|Inf|1"),
+		"malformed time":        encode("time|yesterday|1"),
+	}
+	for name, cursor := range tests {
+		if c, err := parseCursor(cursor); err == nil {
+			t.Errorf("%s: parseCursor accepted %+v", name, c)
+		}
+	}
+}
+
+func TestParsePaginationRejectsMismatchedCursor(t *testing.T) {
+	var f earthquakeFilter
+	cursor := cursorFor("magnitude", Earthquake{Id: 1, Magnitude: 5})
+	if _, err := parsePagination(url.Values{"cursor": {cursor}, "order_by": {"time"}}, &f); err == nil {
+		t.Error("a magnitude cursor was accepted for a listing ordered by time")
+	}
+}
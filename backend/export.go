@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFormats maps download formats to their content type and file extension
+var exportFormats = map[string]struct {
+	contentType string
+	extension   string
+}{
+	"csv":    {"text/csv; charset=utf-8", "csv"},
+	"kml":    {"application/vnd.google-earth.kml+xml", "kml"},
+	"ndjson": {"application/x-ndjson", "ndjson"},
+}
+
+// csvEncoder writes a header row and one row per earthquake. The columns
+// match those accepted by the CSV importer.
+type csvEncoder struct {
+	w            *csv.Writer
+	withDistance bool
+}
+
+func newCSVEncoder(w io.Writer, withDistance bool) *csvEncoder {
+	return &csvEncoder{w: csv.NewWriter(w), withDistance: withDistance}
+}
+
+func (c *csvEncoder) begin() error {
+	header := []string{"event_id", "time", "latitude", "longitude", "depth", "magnitude", "magnitude_type", "place", "alert", "tsunami", "url"}
+	if c.withDistance {
+		header = append(header, "distance_km", "bearing")
+	}
+	return c.w.Write(header)
+}
+
+func (c *csvEncoder) encode(e Earthquake) error {
+	formatFloat := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	record := []string{
+		e.EventId,
+		e.Time.UTC().Format(time.RFC3339Nano),
+		formatFloat(e.Latitude),
+		formatFloat(e.Longitude),
+		formatFloat(e.Depth),
+		formatFloat(e.Magnitude),
+		e.MagnitudeType,
+		e.Place,
+		e.Alert,
+		strconv.Itoa(e.Tsunami),
+		e.URL,
+	}
+	if c.withDistance && e.DistanceKm != nil {
+		record = append(record, formatFloat(*e.DistanceKm), formatFloat(*e.Bearing))
+	}
+	if err := c.w.Write(record); err != nil {
+		return err
+	}
+	// Hand each row to the response so streamed flushes include it
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvEncoder) end() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// kmlMagnitudeStyles are shared placemark styles, one per whole magnitude,
+// with icons growing and shifting from yellow to red as magnitude increases
+const kmlMagnitudeStyles = 10
+
+func kmlStyleID(magnitude float64) string {
+	band := int(math.Floor(magnitude))
+	if band < 0 {
+		band = 0
+	}
+	if band >= kmlMagnitudeStyles {
+		band = kmlMagnitudeStyles - 1
+	}
+	return "mag" + strconv.Itoa(band)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// kmlEncoder writes a KML document with a magnitude-scaled placemark per
+// earthquake. Each placemark's TimeSpan starts at the origin time so the
+// Google Earth time slider can replay the sequence.
+type kmlEncoder struct {
+	w io.Writer
+}
+
+func (k *kmlEncoder) begin() error {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<kml xmlns="http://www.opengis.net/kml/2.2">` + "\n<Document>\n<name>Earthquakes</name>\n")
+	for band := 0; band < kmlMagnitudeStyles; band++ {
+		// KML colors are aabbggrr; fade green out so yellow turns red
+		green := 255 - band*255/(kmlMagnitudeStyles-1)
+		fmt.Fprintf(&b, `<Style id="mag%d"><IconStyle><color>ff00%02xff</color><scale>%.1f</scale>`+
+			`<Icon><href>http://maps.google.com/mapfiles/kml/shapes/shaded_dot.png</href></Icon></IconStyle></Style>`+"\n",
+			band, green, 0.5+0.3*float64(band))
+	}
+	_, err := io.WriteString(k.w, b.String())
+	return err
+}
+
+func (k *kmlEncoder) encode(e Earthquake) error {
+	name := fmt.Sprintf("M %.1f - %s", e.Magnitude, e.Place)
+	description := fmt.Sprintf("Time: %s<br/>Depth: %.1f km<br/>Magnitude: %.1f %s",
+		e.Time.UTC().Format(time.RFC3339), e.Depth, e.Magnitude, e.MagnitudeType)
+	if e.URL != "" {
+		description += fmt.Sprintf(`<br/><a href="%s">Event page</a>`, e.URL)
+	}
+	_, err := fmt.Fprintf(k.w, "<Placemark><name>%s</name><description>%s</description>"+
+		"<TimeSpan><begin>%s</begin></TimeSpan><styleUrl>#%s</styleUrl>"+
+		"<Point><coordinates>%s,%s,0</coordinates></Point></Placemark>\n",
+		xmlEscape(name), xmlEscape(description), e.Time.UTC().Format(time.RFC3339),
+		kmlStyleID(e.Magnitude),
+		strconv.FormatFloat(e.Longitude, 'f', -1, 64), strconv.FormatFloat(e.Latitude, 'f', -1, 64))
+	return err
+}
+
+func (k *kmlEncoder) end() error {
+	_, err := io.WriteString(k.w, "</Document>\n</kml>\n")
+	return err
+}
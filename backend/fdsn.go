@@ -0,0 +1,399 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FDSN event web service, see https://www.fdsn.org/webservices/fdsnws-event-1.2.pdf
+
+const fdsnServiceVersion = "1.2.0"
+
+// fdsnMaxEvents caps the events of one response. Larger requests get a 413,
+// as the specification allows, and should be split up or given a limit.
+const fdsnMaxEvents = 20000
+
+// fdsnParams maps each accepted FDSN parameter (including short aliases) to its canonical name
+var fdsnParams = map[string]string{
+	"starttime":            "starttime",
+	"start":                "starttime",
+	"endtime":              "endtime",
+	"end":                  "endtime",
+	"minlatitude":          "minlatitude",
+	"minlat":               "minlatitude",
+	"maxlatitude":          "maxlatitude",
+	"maxlat":               "maxlatitude",
+	"minlongitude":         "minlongitude",
+	"minlon":               "minlongitude",
+	"maxlongitude":         "maxlongitude",
+	"maxlon":               "maxlongitude",
+	"latitude":             "latitude",
+	"lat":                  "latitude",
+	"longitude":            "longitude",
+	"lon":                  "longitude",
+	"minradius":            "minradius",
+	"maxradius":            "maxradius",
+	"mindepth":             "mindepth",
+	"maxdepth":             "maxdepth",
+	"minmagnitude":         "minmagnitude",
+	"minmag":               "minmagnitude",
+	"maxmagnitude":         "maxmagnitude",
+	"maxmag":               "maxmagnitude",
+	"eventid":              "eventid",
+	"orderby":              "orderby",
+	"limit":                "limit",
+	"offset":               "offset",
+	"format":               "format",
+	"nodata":               "nodata",
+	"includeallorigins":    "includeallorigins",
+	"includeallmagnitudes": "includeallmagnitudes",
+	"includearrivals":      "includearrivals",
+}
+
+type fdsnRequest struct {
+	filter earthquakeFilter
+	format string
+	nodata int
+}
+
+// parseFDSNQuery maps FDSN query parameters onto an earthquakeFilter
+func parseFDSNQuery(query url.Values) (fdsnRequest, error) {
+	req := fdsnRequest{format: "xml", nodata: http.StatusNoContent}
+	params := url.Values{}
+	for name, vals := range query {
+		canonical, ok := fdsnParams[strings.ToLower(name)]
+		if !ok {
+			return req, fmt.Errorf("unsupported parameter %q", name)
+		}
+		if _, dup := params[canonical]; dup {
+			return req, fmt.Errorf("parameter %q given more than once", canonical)
+		}
+		params[canonical] = vals
+	}
+
+	f := &req.filter
+	var err error
+
+	if f.TimeStart, err = fdsnTimeParam(params, "starttime"); err != nil {
+		return req, err
+	}
+	if f.TimeEnd, err = fdsnTimeParam(params, "endtime"); err != nil {
+		return req, err
+	}
+
+	floats := []struct {
+		name     string
+		dst      **float64
+		min, max float64
+	}{
+		{"minlatitude", &f.LatitudeMin, -90, 90},
+		{"maxlatitude", &f.LatitudeMax, -90, 90},
+		{"minlongitude", &f.LongitudeMin, -180, 180},
+		{"maxlongitude", &f.LongitudeMax, -180, 180},
+		{"latitude", &f.Latitude, -90, 90},
+		{"longitude", &f.Longitude, -180, 180},
+		{"minradius", &f.MinRadiusKm, 0, 180},
+		{"maxradius", &f.MaxRadiusKm, 0, 180},
+		{"mindepth", &f.DepthMin, math.Inf(-1), math.Inf(1)},
+		{"maxdepth", &f.DepthMax, math.Inf(-1), math.Inf(1)},
+		{"minmagnitude", &f.MagnitudeMin, math.Inf(-1), math.Inf(1)},
+		{"maxmagnitude", &f.MagnitudeMax, math.Inf(-1), math.Inf(1)},
+	}
+	for _, p := range floats {
+		if *p.dst, err = floatParam(params, p.name); err != nil {
+			return req, fmt.Errorf("invalid %s value %q", p.name, params.Get(p.name))
+		}
+		if v := *p.dst; v != nil && (*v < p.min || *v > p.max) {
+			return req, fmt.Errorf("%s must be between %g and %g", p.name, p.min, p.max)
+		}
+	}
+
+	// Radius search defaults to the whole globe around 0,0; radii are in degrees
+	if f.MinRadiusKm != nil || f.MaxRadiusKm != nil {
+		zero := 0.0
+		if f.Latitude == nil {
+			f.Latitude = &zero
+		}
+		if f.Longitude == nil {
+			f.Longitude = &zero
+		}
+		if f.MinRadiusKm != nil {
+			km := *f.MinRadiusKm * kmPerDegree
+			f.MinRadiusKm = &km
+		}
+		if f.MaxRadiusKm != nil {
+			km := *f.MaxRadiusKm * kmPerDegree
+			f.MaxRadiusKm = &km
+		}
+	}
+
+	f.EventId = params.Get("eventid")
+
+	switch params.Get("orderby") {
+	case "", "time":
+		f.OrderBy, f.Descending = "time", true
+	case "time-asc":
+		f.OrderBy = "time"
+	case "magnitude":
+		f.OrderBy, f.Descending = "magnitude", true
+	case "magnitude-asc":
+		f.OrderBy = "magnitude"
+	default:
+		return req, fmt.Errorf("invalid orderby value %q", params.Get("orderby"))
+	}
+
+	if f.Limit, err = intParam(params, "limit"); err != nil {
+		return req, fmt.Errorf("invalid limit value %q", params.Get("limit"))
+	}
+	if _, ok := params["offset"]; ok {
+		offset, err := intParam(params, "offset")
+		if err != nil || offset < 1 {
+			return req, fmt.Errorf("invalid offset value %q", params.Get("offset"))
+		}
+		// FDSN offsets are 1-based
+		f.Offset = offset - 1
+	}
+
+	if format := params.Get("format"); format != "" {
+		switch format {
+		case "xml", "text", "geojson":
+			req.format = format
+		default:
+			return req, fmt.Errorf("invalid format %q, expected xml, text or geojson", format)
+		}
+	}
+
+	switch params.Get("nodata") {
+	case "", "204":
+	case "404":
+		req.nodata = http.StatusNotFound
+	default:
+		return req, fmt.Errorf("invalid nodata value %q, expected 204 or 404", params.Get("nodata"))
+	}
+
+	// Only the preferred origin and magnitude are stored
+	for _, name := range []string{"includeallorigins", "includeallmagnitudes", "includearrivals"} {
+		if v := params.Get(name); v != "" && v != "false" {
+			return req, fmt.Errorf("%s=%s is not supported", name, v)
+		}
+	}
+
+	return req, nil
+}
+
+// fdsnTimeParam parses FDSN times, which are UTC and may omit the zone, time or fraction
+func fdsnTimeParam(params url.Values, name string) (*time.Time, error) {
+	val, ok := params[name]
+	if !ok {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999", "2006-01-02"} {
+		if t, err := time.Parse(layout, val[0]); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid %s value %q", name, val[0])
+}
+
+// query events using the FDSN event web service protocol
+func handleFDSNQuery(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := parseFDSNQuery(r.URL.Query())
+		if err != nil {
+			fdsnError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Count the matches unless the limit already keeps the response small
+		if f := req.filter; f.Limit == 0 || f.Limit > fdsnMaxEvents {
+			total, err := countEarthquakes(db, f)
+			if err != nil {
+				log.Println("Error counting FDSN query results:", err)
+				fdsnError(w, r, http.StatusInternalServerError, "database query error")
+				return
+			}
+			n := total - f.Offset
+			if f.Limit > 0 && f.Limit < n {
+				n = f.Limit
+			}
+			if n > fdsnMaxEvents {
+				fdsnError(w, r, http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("the request matches %d events, more than the %d one response may hold; narrow the query or page through it with limit and offset", n, fdsnMaxEvents))
+				return
+			}
+		}
+
+		var enc earthquakeEncoder
+		contentType := "application/xml"
+		switch req.format {
+		case "text":
+			contentType = "text/plain"
+			enc = &fdsnTextEncoder{w: w}
+		case "geojson":
+			contentType = "application/geo+json"
+			enc = &geoJSONEncoder{w: w, meta: geoJSONMetadata{
+				URL:   fdsnBaseURL(r) + "query?" + r.URL.RawQuery,
+				Title: "FDSN event query",
+			}}
+		default:
+			enc = &quakemlEncoder{w: w}
+		}
+
+		n, err := streamEarthquakeResponse(r.Context(), w, db, req.filter, enc, func() {
+			w.Header().Set("Content-Type", contentType)
+		})
+		if err != nil {
+			if n == 0 {
+				log.Println("Error executing FDSN query:", err)
+				fdsnError(w, r, http.StatusInternalServerError, "database query error")
+				return
+			}
+			log.Println("Stopped streaming FDSN response after", n, "rows:", err)
+			return
+		}
+		if n == 0 {
+			w.WriteHeader(req.nodata)
+			return
+		}
+		if err := enc.end(); err != nil {
+			log.Println("Error writing FDSN response:", err)
+		}
+	}
+}
+
+// fdsnTextEncoder writes the pipe-delimited FDSN text format
+type fdsnTextEncoder struct {
+	w io.Writer
+}
+
+func (t *fdsnTextEncoder) begin() error {
+	_, err := io.WriteString(t.w, "#EventID|Time|Latitude|Longitude|Depth/km|Author|Catalog|Contributor|ContributorID|MagType|Magnitude|MagAuthor|EventLocationName\n")
+	return err
+}
+
+func (t *fdsnTextEncoder) encode(e Earthquake) error {
+	id := e.EventId
+	if id == "" {
+		id = strconv.Itoa(e.Id)
+	}
+	_, err := fmt.Fprintf(t.w, "%s|%s|%g|%g|%g||||%s|%s|%g||%s\n",
+		id, e.Time.UTC().Format("2006-01-02T15:04:05.000"), e.Latitude, e.Longitude, e.Depth,
+		e.EventId, e.MagnitudeType, e.Magnitude, strings.ReplaceAll(e.Place, "|", " "))
+	return err
+}
+
+func (t *fdsnTextEncoder) end() error { return nil }
+
+// fdsnError writes the plain text error body required by the FDSN specification
+func fdsnError(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "Error %d: %s\n\n%s\n\nUsage details are available from %s\n\nRequest:\n%s\n\nRequest Submitted:\n%s\n\nService version:\n%s\n",
+		status, http.StatusText(status), detail, fdsnBaseURL(r)+"application.wadl",
+		r.URL.String(), time.Now().UTC().Format(time.RFC3339), fdsnServiceVersion)
+}
+
+func fdsnBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + "/fdsnws/event/1/"
+}
+
+// report the FDSN service version
+func handleFDSNVersion() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, fdsnServiceVersion+"\n")
+	}
+}
+
+// describe the query parameters as a WADL document
+func handleFDSNWADL() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, fdsnWADL, fdsnBaseURL(r))
+	}
+}
+
+const fdsnWADL = `<?xml version="1.0" encoding="UTF-8"?>
+<application xmlns="http://wadl.dev.java.net/2009/02" xmlns:xsd="http://www.w3.org/2001/XMLSchema">
+  <resources base="%s">
+    <resource path="query">
+      <method name="GET" id="query">
+        <request>
+          <param name="starttime" style="query" type="xsd:dateTime"/>
+          <param name="endtime" style="query" type="xsd:dateTime"/>
+          <param name="minlatitude" style="query" type="xsd:double" default="-90.0"/>
+          <param name="maxlatitude" style="query" type="xsd:double" default="90.0"/>
+          <param name="minlongitude" style="query" type="xsd:double" default="-180.0"/>
+          <param name="maxlongitude" style="query" type="xsd:double" default="180.0"/>
+          <param name="latitude" style="query" type="xsd:double" default="0.0"/>
+          <param name="longitude" style="query" type="xsd:double" default="0.0"/>
+          <param name="minradius" style="query" type="xsd:double" default="0.0"/>
+          <param name="maxradius" style="query" type="xsd:double" default="180.0"/>
+          <param name="mindepth" style="query" type="xsd:double"/>
+          <param name="maxdepth" style="query" type="xsd:double"/>
+          <param name="minmagnitude" style="query" type="xsd:double"/>
+          <param name="maxmagnitude" style="query" type="xsd:double"/>
+          <param name="eventid" style="query" type="xsd:string"/>
+          <param name="includeallorigins" style="query" type="xsd:boolean" default="false"/>
+          <param name="includeallmagnitudes" style="query" type="xsd:boolean" default="false"/>
+          <param name="includearrivals" style="query" type="xsd:boolean" default="false"/>
+          <param name="limit" style="query" type="xsd:int"/>
+          <param name="offset" style="query" type="xsd:int" default="1"/>
+          <param name="orderby" style="query" type="xsd:string" default="time">
+            <option value="time"/>
+            <option value="time-asc"/>
+            <option value="magnitude"/>
+            <option value="magnitude-asc"/>
+          </param>
+          <param name="format" style="query" type="xsd:string" default="xml">
+            <option value="xml" mediaType="application/xml"/>
+            <option value="text" mediaType="text/plain"/>
+            <option value="geojson" mediaType="application/geo+json"/>
+          </param>
+          <param name="nodata" style="query" type="xsd:int" default="204">
+            <option value="204"/>
+            <option value="404"/>
+          </param>
+        </request>
+        <response status="200">
+          <representation mediaType="application/xml"/>
+          <representation mediaType="text/plain"/>
+          <representation mediaType="application/geo+json"/>
+        </response>
+        <response status="204 400 404 413 500 503">
+          <representation mediaType="text/plain"/>
+        </response>
+      </method>
+    </resource>
+    <resource path="version">
+      <method name="GET">
+        <response>
+          <representation mediaType="text/plain"/>
+        </response>
+      </method>
+    </resource>
+    <resource path="application.wadl">
+      <method name="GET">
+        <response>
+          <representation mediaType="application/xml"/>
+        </response>
+      </method>
+    </resource>
+  </resources>
+</application>
+`
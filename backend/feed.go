@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// usgsFeed mirrors the parts of a USGS GeoJSON summary feed we ingest.
+// See https://earthquake.usgs.gov/earthquakes/feed/v1.0/geojson.php
+type usgsFeed struct {
+	Type     string        `json:"type"`
+	Features []usgsFeature `json:"features"`
+}
+
+type usgsFeature struct {
+	Id         string `json:"id"`
+	Properties struct {
+		Mag     *float64 `json:"mag"`
+		MagType string   `json:"magType"`
+		Place   string   `json:"place"`
+		Time    int64    `json:"time"`
+		Updated int64    `json:"updated"`
+		Alert   string   `json:"alert"`
+		Tsunami int      `json:"tsunami"`
+		URL     string   `json:"url"`
+	} `json:"properties"`
+	Geometry struct {
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+}
+
+// feedEvent is an earthquake along with the time USGS last revised it
+type feedEvent struct {
+	Earthquake
+	Updated time.Time
+}
+
+var feedClient = &http.Client{Timeout: 30 * time.Second}
+
+// openFeed opens a feed from a local file path or an http(s) URL
+func openFeed(source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.Open(source)
+	}
+
+	resp, err := feedClient.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: unexpected status %s", source, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// parseGeoJSONFeed decodes a USGS FeatureCollection into events.
+// Features without an id, magnitude or coordinates are skipped.
+func parseGeoJSONFeed(r io.Reader) ([]feedEvent, error) {
+	var feed usgsFeed
+	if err := json.NewDecoder(r).Decode(&feed); err != nil {
+		return nil, err
+	}
+	if feed.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("expected a FeatureCollection, got %q", feed.Type)
+	}
+
+	events := make([]feedEvent, 0, len(feed.Features))
+	for i, f := range feed.Features {
+		coords := f.Geometry.Coordinates
+		if len(coords) < 2 {
+			log.Printf("Skipping feature %d (%s): missing coordinates", i, f.Id)
+			continue
+		}
+		if f.Id == "" {
+			log.Printf("Skipping feature %d: missing id", i)
+			continue
+		}
+		if f.Properties.Mag == nil {
+			log.Printf("Skipping feature %d (%s): missing magnitude", i, f.Id)
+			continue
+		}
+
+		e := Earthquake{
+			EventId:       f.Id,
+			Time:          time.UnixMilli(f.Properties.Time).UTC(),
+			Longitude:     coords[0],
+			Latitude:      coords[1],
+			Magnitude:     *f.Properties.Mag,
+			MagnitudeType: f.Properties.MagType,
+			Place:         f.Properties.Place,
+			Alert:         f.Properties.Alert,
+			Tsunami:       f.Properties.Tsunami,
+			URL:           f.Properties.URL,
+		}
+		if len(coords) > 2 {
+			e.Depth = coords[2]
+		}
+
+		updated := e.Time
+		if f.Properties.Updated != 0 {
+			updated = time.UnixMilli(f.Properties.Updated).UTC()
+		}
+		events = append(events, feedEvent{Earthquake: e, Updated: updated})
+	}
+
+	return events, nil
+}
+
+// upsertEarthquakes writes earthquakes in a single transaction, replacing
+// any existing row with the same upstream event id. It returns the number
+// of rows written.
+func upsertEarthquakes(db *sql.DB, earthquakes []Earthquake) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	written := 0
+	for start := 0; start < len(earthquakes); start += upsertBatchSize {
+		end := start + upsertBatchSize
+		if end > len(earthquakes) {
+			end = len(earthquakes)
+		}
+		n, err := upsertEarthquakeBatch(tx, earthquakes[start:end])
+		if err != nil {
+			return 0, err
+		}
+		written += n
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+// upsertBatchSize keeps multi-row upserts well under Postgres' 65535 parameter limit
+const upsertBatchSize = 500
+
+// upsertEarthquakeBatch writes a batch with one multi-row INSERT ... ON CONFLICT.
+// Postgres rejects a statement that updates the same row twice, so only the
+// last occurrence of a repeated event id in the batch is kept. It returns the
+// number of rows written.
+func upsertEarthquakeBatch(tx *sql.Tx, batch []Earthquake) (int, error) {
+	last := make(map[string]int, len(batch))
+	for i, e := range batch {
+		if e.EventId == "" {
+			return 0, fmt.Errorf("earthquake at %s has no event id", e.Time)
+		}
+		last[e.EventId] = i
+	}
+
+	var values []string
+	var args []interface{}
+	for i, e := range batch {
+		if last[e.EventId] != i {
+			continue
+		}
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)",
+			n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10, n+11))
+		args = append(args, e.EventId, e.Time, e.Latitude, e.Longitude, e.Depth, e.Magnitude, e.MagnitudeType, e.Place, e.Alert, e.Tsunami, e.URL)
+	}
+	if len(values) == 0 {
+		return 0, nil
+	}
+
+	_, err := tx.Exec(`
+	INSERT INTO earthquakes (event_id, time, latitude, longitude, depth, magnitude, magnitude_type, place, alert, tsunami, url)
+	VALUES `+strings.Join(values, ", ")+`
+	ON CONFLICT (event_id) DO UPDATE SET
+		time = EXCLUDED.time, latitude = EXCLUDED.latitude, longitude = EXCLUDED.longitude,
+		depth = EXCLUDED.depth, magnitude = EXCLUDED.magnitude, magnitude_type = EXCLUDED.magnitude_type, place = EXCLUDED.place,
+		alert = EXCLUDED.alert, tsunami = EXCLUDED.tsunami, url = EXCLUDED.url`,
+		args...)
+	if err != nil {
+		return 0, err
+	}
+	return len(values), nil
+}
+
+// eventIDFromURL extracts the upstream event id from a USGS event page URL,
+// e.g. https://earthquake.usgs.gov/earthquakes/eventpage/us7000abcd
+func eventIDFromURL(url string) string {
+	url = strings.TrimSpace(url)
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		url = url[:i]
+	}
+	url = strings.TrimRight(url, "/")
+	return url[strings.LastIndex(url, "/")+1:]
+}
+
+// eventIDFromURLSQL is eventIDFromURL as a Postgres expression over the url column
+const eventIDFromURLSQL = `regexp_replace(rtrim(split_part(split_part(btrim(url, E' \t\r\n'), '?', 1), '#', 1), '/'), '^.*/', '')`
+
+// ingestFeed loads a USGS GeoJSON feed from a file or URL into the earthquakes table
+func ingestFeed(db *sql.DB, source string) (int, error) {
+	body, err := openFeed(source)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	events, err := parseGeoJSONFeed(body)
+	if err != nil {
+		return 0, fmt.Errorf("parsing feed %s: %w", source, err)
+	}
+
+	earthquakes := make([]Earthquake, len(events))
+	for i, ev := range events {
+		earthquakes[i] = ev.Earthquake
+	}
+
+	n, err := upsertEarthquakes(db, earthquakes)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Ingested %d earthquakes from %s", n, source)
+	return n, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGeoJSONFeed(t *testing.T) {
+	f, err := openFeed("testdata/usgs_feed.geojson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	events, err := parseGeoJSONFeed(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The feature with a null mag and the one without an id are skipped
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+
+	e := events[0]
+	if e.EventId != "us7000kufc" || e.Magnitude != 4.7 || e.MagnitudeType != "mww" {
+		t.Errorf("first event = %+v", e.Earthquake)
+	}
+	if e.Longitude != -160.2143 || e.Latitude != 54.8912 || e.Depth != 35.4 {
+		t.Errorf("first event at %g, %g, %g km", e.Longitude, e.Latitude, e.Depth)
+	}
+	if e.Alert != "green" || e.Tsunami != 1 || e.URL != "https://earthquake.usgs.gov/earthquakes/eventpage/us7000kufc" {
+		t.Errorf("first event alert %q, tsunami %d, url %q", e.Alert, e.Tsunami, e.URL)
+	}
+	if want := time.UnixMilli(1699999812345).UTC(); !e.Time.Equal(want) {
+		t.Errorf("first event time %s, want %s", e.Time, want)
+	}
+	if want := time.UnixMilli(1700000123456).UTC(); !e.Updated.Equal(want) {
+		t.Errorf("first event updated %s, want %s", e.Updated, want)
+	}
+
+	// A null alert reads as no alert
+	if events[1].EventId != "nc73951234" || events[1].Alert != "" {
+		t.Errorf("second event %q has alert %q", events[1].EventId, events[1].Alert)
+	}
+}
+
+func TestParseGeoJSONFeedRejectsOtherTypes(t *testing.T) {
+	if _, err := parseGeoJSONFeed(strings.NewReader(`{"type":"Feature"}`)); err == nil {
+		t.Error("expected an error for a Feature")
+	}
+	if _, err := parseGeoJSONFeed(strings.NewReader(`<html>`)); err == nil {
+		t.Error("expected an error for invalid JSON")
+	}
+}
+
+func TestOpenFeedOverHTTP(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/usgs_feed.geojson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/summary/all_hour.geojson" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(fixture)
+	}))
+	defer server.Close()
+
+	body, err := openFeed(server.URL + "/summary/all_hour.geojson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	events, err := parseGeoJSONFeed(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("got %d events, want 2", len(events))
+	}
+
+	// A non-200 response is an error and never reaches the database
+	if _, err := openFeed(server.URL + "/missing.geojson"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("openFeed on a 404 returned %v", err)
+	}
+	if _, err := ingestFeed(nil, server.URL+"/missing.geojson"); err == nil {
+		t.Error("ingestFeed on a 404 returned no error")
+	}
+}
+
+func TestIngestFeedRejectsMalformedFeeds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"type":"FeatureCollection","features":[`)
+	}))
+	defer server.Close()
+
+	if _, err := ingestFeed(nil, server.URL); err == nil || !strings.Contains(err.Error(), "parsing feed") {
+		t.Errorf("ingestFeed on a truncated feed returned %v", err)
+	}
+}
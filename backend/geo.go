@@ -0,0 +1,66 @@
+package main
+
+import "math"
+
+// earthRadiusKm is the mean Earth radius used for great-circle distances
+const earthRadiusKm = 6371.0088
+
+// kmPerDegree is the length in km of a degree of great-circle arc, such as a
+// degree of latitude
+const kmPerDegree = earthRadiusKm * math.Pi / 180
+
+func radians(deg float64) float64 { return deg * math.Pi / 180 }
+
+func degrees(rad float64) float64 { return rad * 180 / math.Pi }
+
+// haversineKm is the great-circle distance in km between two points
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	dLat := radians(lat2 - lat1)
+	dLon := radians(lon2 - lon1)
+	a := math.Pow(math.Sin(dLat/2), 2) +
+		math.Cos(radians(lat1))*math.Cos(radians(lat2))*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// bearingDegrees is the initial bearing from the first point to the second,
+// clockwise from true north in [0, 360)
+func bearingDegrees(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1, phi2 := radians(lat1), radians(lat2)
+	dLon := radians(lon2 - lon1)
+	y := math.Sin(dLon) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLon)
+	return math.Mod(degrees(math.Atan2(y, x))+360, 360)
+}
+
+// normalizeLongitude wraps a longitude into [-180, 180]
+func normalizeLongitude(lon float64) float64 {
+	if lon >= -180 && lon <= 180 {
+		return lon
+	}
+	lon = math.Mod(lon+180, 360)
+	if lon < 0 {
+		lon += 360
+	}
+	return lon - 180
+}
+
+// normalizeLongitudeRange wraps both ends of a longitude range into [-180, 180].
+// A range spanning 360 degrees or more covers the whole globe. The result has
+// min > max when the range crosses the antimeridian, e.g. 170 to -170.
+func normalizeLongitudeRange(min, max float64) (float64, float64) {
+	if max-min >= 360 {
+		return -180, 180
+	}
+	return normalizeLongitude(min), normalizeLongitude(max)
+}
+
+// destinationPoint is the point distanceKm along the great circle leaving
+// lat, lon at the given bearing. The longitude is not wrapped, so a path
+// across the antimeridian continues past ±180.
+func destinationPoint(lat, lon, bearing, distanceKm float64) (float64, float64) {
+	delta := distanceKm / earthRadiusKm
+	phi1, theta := radians(lat), radians(bearing)
+	phi2 := math.Asin(math.Sin(phi1)*math.Cos(delta) + math.Cos(phi1)*math.Sin(delta)*math.Cos(theta))
+	dLon := math.Atan2(math.Sin(theta)*math.Sin(delta)*math.Cos(phi1), math.Cos(delta)-math.Sin(phi1)*math.Sin(phi2))
+	return degrees(phi2), lon + degrees(dLon)
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestNormalizeLongitudeRange(t *testing.T) {
+	tests := []struct {
+		name                string
+		min, max            float64
+		wantMin, wantMax    float64
+		crossesAntimeridian bool
+	}{
+		{"Aleutians", 170, -170, 170, -170, true},
+		{"western Aleutians", 172, -172, 172, -172, true},
+		{"Fiji", 177, -178, 177, -178, true},
+		{"New Zealand", 165, 180, 165, 180, false},
+		{"Aleutians past 180", 170, 190, 170, -170, true},
+		{"Fiji past 180", 177, 182, 177, -178, true},
+		{"both ends past 180", 190, 200, -170, -160, false},
+		{"both ends below -180", -190, -170, 170, -170, true},
+		{"ordinary box", -125, -114, -125, -114, false},
+		{"whole globe", -180, 180, -180, 180, false},
+		{"whole globe from 0", 0, 360, -180, 180, false},
+		{"more than the globe", -200, 200, -180, 180, false},
+	}
+	for _, tt := range tests {
+		min, max := normalizeLongitudeRange(tt.min, tt.max)
+		if min != tt.wantMin || max != tt.wantMax {
+			t.Errorf("%s: normalizeLongitudeRange(%g, %g) = %g, %g, want %g, %g",
+				tt.name, tt.min, tt.max, min, max, tt.wantMin, tt.wantMax)
+		}
+		if crosses := min > max; crosses != tt.crossesAntimeridian {
+			t.Errorf("%s: crosses the antimeridian = %t, want %t", tt.name, crosses, tt.crossesAntimeridian)
+		}
+	}
+}
+
+func TestNormalizeLongitude(t *testing.T) {
+	tests := []struct{ in, want float64 }{
+		{0, 0},
+		{180, 180},
+		{-180, -180},
+		{190, -170},
+		{-190, 170},
+		{540, -180},
+		{359, -1},
+	}
+	for _, tt := range tests {
+		if got := normalizeLongitude(tt.in); got != tt.want {
+			t.Errorf("normalizeLongitude(%g) = %g, want %g", tt.in, got, tt.want)
+		}
+	}
+}
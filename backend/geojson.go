@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+)
+
+// geoJSONMetadata describes the query that produced a FeatureCollection,
+// in the spirit of the USGS feeds' metadata block
+type geoJSONMetadata struct {
+	Generated  time.Time `json:"generated"`
+	URL        string    `json:"url,omitempty"`
+	Title      string    `json:"title"`
+	Count      int       `json:"count"`
+	Total      *int      `json:"total,omitempty"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Id         string                 `json:"id,omitempty"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// earthquakeFeature converts an earthquake to a Point feature with
+// [longitude, latitude, depth] coordinates
+func earthquakeFeature(e Earthquake) geoJSONFeature {
+	f := geoJSONFeature{
+		Type: "Feature",
+		Id:   e.EventId,
+		Geometry: geoJSONGeometry{
+			Type:        "Point",
+			Coordinates: []float64{e.Longitude, e.Latitude, e.Depth},
+		},
+		Properties: map[string]interface{}{
+			"id":             e.Id,
+			"event_id":       e.EventId,
+			"time":           e.Time.UTC().Format(time.RFC3339Nano),
+			"magnitude":      e.Magnitude,
+			"magnitude_type": e.MagnitudeType,
+			"depth":          e.Depth,
+			"place":          e.Place,
+			"alert":          e.Alert,
+			"tsunami":        e.Tsunami,
+			"url":            e.URL,
+		},
+	}
+	if e.DistanceKm != nil {
+		f.Properties["distance_km"] = *e.DistanceKm
+		f.Properties["bearing"] = *e.Bearing
+	}
+	return f
+}
+
+// geoJSONEncoder streams a FeatureCollection. The bbox and metadata members
+// follow the features so they can be computed as the features are written.
+type geoJSONEncoder struct {
+	w     io.Writer
+	meta  geoJSONMetadata
+	bbox  []float64
+	count int
+}
+
+func (g *geoJSONEncoder) begin() error {
+	_, err := io.WriteString(g.w, `{"type":"FeatureCollection","features":[`)
+	return err
+}
+
+func (g *geoJSONEncoder) encode(e Earthquake) error {
+	b, err := json.Marshal(earthquakeFeature(e))
+	if err != nil {
+		return err
+	}
+	if g.count > 0 {
+		if _, err := io.WriteString(g.w, ","); err != nil {
+			return err
+		}
+	}
+	g.count++
+
+	// bbox is [west, south, shallowest, east, north, deepest]
+	if g.bbox == nil {
+		g.bbox = []float64{e.Longitude, e.Latitude, e.Depth, e.Longitude, e.Latitude, e.Depth}
+	} else {
+		g.bbox[0] = math.Min(g.bbox[0], e.Longitude)
+		g.bbox[1] = math.Min(g.bbox[1], e.Latitude)
+		g.bbox[2] = math.Min(g.bbox[2], e.Depth)
+		g.bbox[3] = math.Max(g.bbox[3], e.Longitude)
+		g.bbox[4] = math.Max(g.bbox[4], e.Latitude)
+		g.bbox[5] = math.Max(g.bbox[5], e.Depth)
+	}
+
+	_, err = g.w.Write(b)
+	return err
+}
+
+func (g *geoJSONEncoder) end() error {
+	g.meta.Generated = time.Now().UTC()
+	g.meta.Count = g.count
+	tail := struct {
+		BBox     []float64       `json:"bbox,omitempty"`
+		Metadata geoJSONMetadata `json:"metadata"`
+	}{g.bbox, g.meta}
+
+	b, err := json.Marshal(tail)
+	if err != nil {
+		return err
+	}
+	// Splice the tail object's members in after the features array
+	if _, err := io.WriteString(g.w, "],"); err != nil {
+		return err
+	}
+	_, err = g.w.Write(append(b[1:], '\n'))
+	return err
+}
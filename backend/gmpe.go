@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Boore, Joyner & Fumal (1997) coefficients for peak ground acceleration,
+// random horizontal component, with the mechanism unspecified
+const (
+	bjf97B1       = -0.242
+	bjf97B2       = 0.527
+	bjf97B3       = 0.0
+	bjf97B5       = -0.778
+	bjf97BV       = -0.371
+	bjf97VA       = 1396.0 // m/s
+	bjf97H        = 5.57   // km, fictitious depth
+	bjf97Min      = 5.5    // the magnitude, distance and depth range the equation was fit over
+	bjf97Max      = 7.5
+	bjf97Km       = 80.0
+	bjf97MaxDepth = 20.0 // km, shallow crustal earthquakes only
+)
+
+// defaultVs30 is the site shear wave velocity in m/s assumed when none is
+// given, the NEHRP B/C boundary
+const defaultVs30 = 760.0
+
+// maxShakingSites caps the sites of a batch request
+const maxShakingSites = 1000
+
+// maxShakingBytes caps the size of a batch request body, room for
+// maxShakingSites sites with long names
+const maxShakingBytes = 1 << 20
+
+// shakingModel names the equations behind shaking estimates in responses
+const shakingModel = "Boore, Joyner & Fumal (1997) PGA; Worden et al. (2012) GMICE"
+
+// gravityCmS2 is standard gravity in cm/s²
+const gravityCmS2 = 980.665
+
+// bjf97PGA is the median peak ground acceleration in g at Joyner-Boore
+// distance rjb km from an earthquake of moment magnitude m, on a site with
+// the given Vs30 in m/s
+func bjf97PGA(m, rjb, vs30 float64) float64 {
+	r := math.Sqrt(rjb*rjb + bjf97H*bjf97H)
+	lnY := bjf97B1 + bjf97B2*(m-6) + bjf97B3*(m-6)*(m-6) + bjf97B5*math.Log(r) + bjf97BV*math.Log(vs30/bjf97VA)
+	return math.Exp(lnY)
+}
+
+// bjf97OutsideRange reports whether an earthquake of magnitude m and the
+// given depth, seen from distanceKm, is beyond the range BJF97 was fit over
+func bjf97OutsideRange(m, depth, distanceKm float64) bool {
+	return m < bjf97Min || m > bjf97Max || depth > bjf97MaxDepth || distanceKm > bjf97Km
+}
+
+// hypocentralKm is the straight-line distance to a hypocentre depth km below
+// a point epicentralKm from the site
+func hypocentralKm(epicentralKm, depth float64) float64 {
+	return math.Sqrt(epicentralKm*epicentralKm + depth*depth)
+}
+
+// wordenMMI converts peak ground acceleration in cm/s² to Modified Mercalli
+// Intensity with the Worden et al. (2012) relation for California, limited
+// to the I to X range of the scale
+func wordenMMI(pgaCmS2 float64) float64 {
+	logPGA := math.Log10(pgaCmS2)
+	mmi := 1.78 + 1.55*logPGA
+	if logPGA > 1.57 {
+		mmi = -1.60 + 3.70*logPGA
+	}
+	return math.Max(1, math.Min(10, mmi))
+}
+
+// mmiLabels are the perceived shaking of each intensity on the USGS scale
+var mmiLabels = []string{"Not felt", "Weak", "Weak", "Light", "Moderate", "Strong", "Very strong", "Severe", "Violent", "Extreme"}
+
+var romanNumerals = []string{"I", "II", "III", "IV", "V", "VI", "VII", "VIII", "IX", "X"}
+
+// shakingSite is a location to estimate ground motion at
+type shakingSite struct {
+	Name      string   `json:"name,omitempty"`
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Vs30      *float64 `json:"vs30,omitempty"`
+}
+
+// siteShaking is the estimated ground motion at a site. OutsideValidRange marks
+// estimates beyond the magnitude, distance or depth range of the equation.
+type siteShaking struct {
+	Site                  shakingSite `json:"site"`
+	Vs30                  float64     `json:"vs30"`
+	EpicentralDistanceKm  float64     `json:"epicentral_distance_km"`
+	HypocentralDistanceKm float64     `json:"hypocentral_distance_km"`
+	PGAg                  float64     `json:"pga_g"`
+	PGACmS2               float64     `json:"pga_cm_s2"`
+	MMI                   float64     `json:"mmi"`
+	Intensity             string      `json:"intensity"`
+	Shaking               string      `json:"shaking"`
+	OutsideValidRange     bool        `json:"outside_valid_range"`
+}
+
+// estimateShaking applies BJF97 and the Worden et al. (2012) GMICE at a site.
+// The hypocentral distance stands in for the Joyner-Boore distance, treating
+// the earthquake as a point source, so deeper events shake the surface less.
+func estimateShaking(e Earthquake, site shakingSite) siteShaking {
+	vs30 := defaultVs30
+	if site.Vs30 != nil {
+		vs30 = *site.Vs30
+	}
+	epicentral := haversineKm(e.Latitude, e.Longitude, site.Latitude, site.Longitude)
+	hypocentral := hypocentralKm(epicentral, e.Depth)
+	pga := bjf97PGA(e.Magnitude, hypocentral, vs30)
+	mmi := wordenMMI(pga * gravityCmS2)
+	level := int(math.Floor(mmi)) - 1
+
+	return siteShaking{
+		Site:                  site,
+		Vs30:                  vs30,
+		EpicentralDistanceKm:  epicentral,
+		HypocentralDistanceKm: hypocentral,
+		PGAg:                  pga,
+		PGACmS2:               pga * gravityCmS2,
+		MMI:                   mmi,
+		Intensity:             romanNumerals[level],
+		Shaking:               mmiLabels[level],
+		OutsideValidRange:     bjf97OutsideRange(e.Magnitude, e.Depth, hypocentral),
+	}
+}
+
+// validateSite checks a site's coordinates and Vs30. The comparisons are
+// written so NaN fails them.
+func validateSite(site shakingSite) error {
+	if !(site.Latitude >= -90 && site.Latitude <= 90) {
+		return fmt.Errorf("Invalid latitude %g", site.Latitude)
+	}
+	if !(site.Longitude >= -180 && site.Longitude <= 180) {
+		return fmt.Errorf("Invalid longitude %g", site.Longitude)
+	}
+	if site.Vs30 != nil && !(*site.Vs30 > 0 && !math.IsInf(*site.Vs30, 1)) {
+		return fmt.Errorf("Invalid vs30 %g", *site.Vs30)
+	}
+	return nil
+}
+
+// estimate how strongly an earthquake shook one site, given by the lat, lon
+// and optional vs30 parameters, or with POST a batch of sites in the body
+func getSiteShaking(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := getUserIDFromContext(r.Context()); err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var sites []shakingSite
+		if r.Method == http.MethodPost {
+			var body struct {
+				Sites []shakingSite `json:"sites"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxShakingBytes)).Decode(&body); err != nil {
+				http.Error(w, "Invalid JSON: "+err.Error(), bodyStatus(err))
+				return
+			}
+			if len(body.Sites) == 0 || len(body.Sites) > maxShakingSites {
+				http.Error(w, fmt.Sprintf("Expected between 1 and %d sites", maxShakingSites), http.StatusBadRequest)
+				return
+			}
+			sites = body.Sites
+		} else {
+			query := r.URL.Query()
+			lat, errLat := floatParam(query, "lat")
+			lon, errLon := floatParam(query, "lon")
+			vs30, errVs30 := floatParam(query, "vs30")
+			if errLat != nil || errLon != nil || errVs30 != nil || lat == nil || lon == nil {
+				http.Error(w, "Expected numeric lat and lon parameters and an optional vs30", http.StatusBadRequest)
+				return
+			}
+			sites = []shakingSite{{Latitude: *lat, Longitude: *lon, Vs30: vs30}}
+		}
+		for _, site := range sites {
+			if err := validateSite(site); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		e, err := findEarthquake(r, db, mux.Vars(r)["id"])
+		if err == sql.ErrNoRows {
+			http.Error(w, "Earthquake not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Error fetching earthquake:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		estimates := make([]siteShaking, 0, len(sites))
+		for _, site := range sites {
+			estimates = append(estimates, estimateShaking(e, site))
+		}
+
+		response := struct {
+			Earthquake Earthquake    `json:"earthquake"`
+			Model      string        `json:"model"`
+			Sites      []siteShaking `json:"sites"`
+		}{e, shakingModel, estimates}
+		json.NewEncoder(w).Encode(response)
+	}
+}
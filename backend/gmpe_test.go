@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateSite(t *testing.T) {
+	nan, inf, zero, rock := math.NaN(), math.Inf(1), 0.0, 1100.0
+	tests := []struct {
+		name  string
+		site  shakingSite
+		valid bool
+	}{
+		{"valid", shakingSite{Latitude: 61.2, Longitude: -149.9}, true},
+		{"valid with vs30", shakingSite{Latitude: 61.2, Longitude: -149.9, Vs30: &rock}, true},
+		{"NaN latitude", shakingSite{Latitude: nan, Longitude: -149.9}, false},
+		{"NaN longitude", shakingSite{Latitude: 61.2, Longitude: nan}, false},
+		{"latitude out of range", shakingSite{Latitude: 91, Longitude: 0}, false},
+		{"longitude out of range", shakingSite{Latitude: 0, Longitude: -181}, false},
+		{"NaN vs30", shakingSite{Latitude: 61.2, Longitude: -149.9, Vs30: &nan}, false},
+		{"infinite vs30", shakingSite{Latitude: 61.2, Longitude: -149.9, Vs30: &inf}, false},
+		{"zero vs30", shakingSite{Latitude: 61.2, Longitude: -149.9, Vs30: &zero}, false},
+	}
+	for _, tt := range tests {
+		if err := validateSite(tt.site); (err == nil) != tt.valid {
+			t.Errorf("%s: validateSite() = %v, want valid %t", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestEstimateShakingDepth(t *testing.T) {
+	site := shakingSite{Latitude: -17.9, Longitude: -178.5}
+	shallow := estimateShaking(Earthquake{Latitude: -17.9, Longitude: -178.5, Magnitude: 7, Depth: 10}, site)
+	deep := estimateShaking(Earthquake{Latitude: -17.9, Longitude: -178.5, Magnitude: 7, Depth: 600}, site)
+
+	if shallow.MMI < 6 || shallow.OutsideValidRange {
+		t.Errorf("M7 10 km below the site: MMI %.1f, outside valid range %t", shallow.MMI, shallow.OutsideValidRange)
+	}
+	// 600 km of rock between the source and the site weakens the shaking
+	if deep.MMI >= 4 || !deep.OutsideValidRange {
+		t.Errorf("M7 600 km below the site: MMI %.1f, outside valid range %t", deep.MMI, deep.OutsideValidRange)
+	}
+	if deep.EpicentralDistanceKm != 0 || deep.HypocentralDistanceKm != 600 {
+		t.Errorf("distances = %g, %g, want 0, 600", deep.EpicentralDistanceKm, deep.HypocentralDistanceKm)
+	}
+}
+
+func TestSiteShakingLimitsBody(t *testing.T) {
+	body := `{"sites":[{"name":"` + strings.Repeat("x", maxShakingBytes) + `","latitude":0,"longitude":0}]}`
+	r := httptest.NewRequest(http.MethodPost, "/api/go/earthquakes/1/shaking", strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), "user_id", "1"))
+	w := httptest.NewRecorder()
+	getSiteShaking(nil)(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status of an oversized body = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// defaultCellSize is the grid cell size in degrees used when none is given
+const defaultCellSize = 1.0
+
+// gridCell is the aggregate of the earthquakes in one grid cell. Latitude and
+// longitude are the cell centre; Polygon is its outline as a closed ring of
+// [longitude, latitude] pairs.
+type gridCell struct {
+	Latitude     float64      `json:"latitude"`
+	Longitude    float64      `json:"longitude"`
+	Count        int          `json:"count"`
+	MaxMagnitude float64      `json:"max_magnitude"`
+	Polygon      [][2]float64 `json:"polygon"`
+}
+
+// cellGrid assigns points to cells and describes the cells
+type cellGrid interface {
+	cell(lon, lat float64) [2]int
+	centre(key [2]int) (lon, lat float64)
+	polygon(key [2]int) [][2]float64
+}
+
+// squareGrid divides longitude and latitude into equal steps of size degrees
+type squareGrid struct {
+	size float64
+}
+
+func (g squareGrid) cell(lon, lat float64) [2]int {
+	return [2]int{int(math.Floor(lon / g.size)), int(math.Floor(lat / g.size))}
+}
+
+func (g squareGrid) centre(key [2]int) (float64, float64) {
+	return (float64(key[0]) + 0.5) * g.size, (float64(key[1]) + 0.5) * g.size
+}
+
+func (g squareGrid) polygon(key [2]int) [][2]float64 {
+	west, south := float64(key[0])*g.size, float64(key[1])*g.size
+	east, north := west+g.size, south+g.size
+	return [][2]float64{{west, south}, {east, south}, {east, north}, {west, north}, {west, south}}
+}
+
+// hexGrid is a grid of pointy-top hexagons in longitude/latitude space,
+// addressed by axial coordinates. size is the distance in degrees between
+// the centres of neighbouring cells in a row.
+type hexGrid struct {
+	size float64
+}
+
+// radius is the centre to corner distance of a cell
+func (g hexGrid) radius() float64 { return g.size / math.Sqrt(3) }
+
+func (g hexGrid) cell(lon, lat float64) [2]int {
+	r := g.radius()
+	q := (math.Sqrt(3)/3*lon - lat/3) / r
+	s := (2.0 / 3 * lat) / r
+
+	// Round the fractional cube coordinates to the nearest hexagon, fixing
+	// up whichever coordinate was rounded furthest so they still sum to zero
+	x, z := q, s
+	y := -x - z
+	rx, ry, rz := math.Round(x), math.Round(y), math.Round(z)
+	dx, dy, dz := math.Abs(rx-x), math.Abs(ry-y), math.Abs(rz-z)
+	if dx > dy && dx > dz {
+		rx = -ry - rz
+	} else if dy <= dz {
+		rz = -rx - ry
+	}
+	return [2]int{int(rx), int(rz)}
+}
+
+func (g hexGrid) centre(key [2]int) (float64, float64) {
+	r := g.radius()
+	q, s := float64(key[0]), float64(key[1])
+	return r * math.Sqrt(3) * (q + s/2), r * 1.5 * s
+}
+
+func (g hexGrid) polygon(key [2]int) [][2]float64 {
+	lon, lat := g.centre(key)
+	r := g.radius()
+	ring := make([][2]float64, 0, 7)
+	for i := 0; i <= 6; i++ {
+		angle := radians(float64(60*(i%6) + 30))
+		ring = append(ring, [2]float64{lon + r*math.Cos(angle), lat + r*math.Sin(angle)})
+	}
+	return ring
+}
+
+// aggregate earthquakes matching the getEarthquakes filters onto a square or
+// hexagonal grid, for rendering density heatmaps instead of every point
+func getEarthquakeGrid(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		filter, status, err := requestFilter(db, r, userID)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		query := r.URL.Query()
+		size := defaultCellSize
+		if v, err := floatParam(query, "cell_size"); err != nil || (v != nil && (*v <= 0 || *v > 90)) {
+			http.Error(w, "Invalid cell_size value, expected degrees between 0 and 90", http.StatusBadRequest)
+			return
+		} else if v != nil {
+			size = *v
+		}
+
+		shape := query.Get("shape")
+		if shape == "" {
+			shape = "square"
+		}
+		var grid cellGrid
+		switch shape {
+		case "square":
+			grid = squareGrid{size}
+		case "hex":
+			grid = hexGrid{size}
+		default:
+			http.Error(w, "Invalid shape, expected square or hex", http.StatusBadRequest)
+			return
+		}
+
+		format := query.Get("format")
+		if format != "" && format != "json" && format != "geojson" {
+			http.Error(w, "Invalid format, expected json or geojson", http.StatusBadRequest)
+			return
+		}
+
+		cells := map[[2]int]*gridCell{}
+		err = streamEarthquakes(r.Context(), db, filter, func(e Earthquake) error {
+			key := grid.cell(e.Longitude, e.Latitude)
+			c, ok := cells[key]
+			if !ok {
+				lon, lat := grid.centre(key)
+				c = &gridCell{Latitude: lat, Longitude: lon, MaxMagnitude: e.Magnitude, Polygon: grid.polygon(key)}
+				cells[key] = c
+			}
+			c.Count++
+			c.MaxMagnitude = math.Max(c.MaxMagnitude, e.Magnitude)
+			return nil
+		})
+		if err != nil {
+			log.Println("Error gridding earthquakes:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		result := make([]gridCell, 0, len(cells))
+		for _, c := range cells {
+			result = append(result, *c)
+		}
+		sort.Slice(result, func(i, j int) bool {
+			if result[i].Latitude != result[j].Latitude {
+				return result[i].Latitude < result[j].Latitude
+			}
+			return result[i].Longitude < result[j].Longitude
+		})
+
+		if format == "geojson" {
+			features := make([]geoJSONFeature, 0, len(result))
+			for _, c := range result {
+				features = append(features, geoJSONFeature{
+					Type:     "Feature",
+					Geometry: geoJSONGeometry{Type: "Polygon", Coordinates: [][][2]float64{c.Polygon}},
+					Properties: map[string]interface{}{
+						"latitude":      c.Latitude,
+						"longitude":     c.Longitude,
+						"count":         c.Count,
+						"max_magnitude": c.MaxMagnitude,
+					},
+				})
+			}
+			w.Header().Set("Content-Type", "application/geo+json")
+			json.NewEncoder(w).Encode(struct {
+				Type     string           `json:"type"`
+				Features []geoJSONFeature `json:"features"`
+			}{"FeatureCollection", features})
+			return
+		}
+
+		json.NewEncoder(w).Encode(struct {
+			CellSize float64    `json:"cell_size"`
+			Shape    string     `json:"shape"`
+			Cells    []gridCell `json:"cells"`
+		}{size, shape, result})
+	}
+}
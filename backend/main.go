@@ -3,8 +3,8 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/csv"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -42,38 +42,91 @@ type Preference struct {
 	LongitudeMax float64   `json:"longitude_max"`
 	LatitudeMin  float64   `json:"latitude_min"`
 	LatitudeMax  float64   `json:"latitude_max"`
+
+	// Region is an optional GeoJSON Polygon or MultiPolygon search area
+	Region json.RawMessage `json:"region,omitempty"`
 }
 
 type Earthquake struct {
-    Id        int    `json:"id"`
-    Time      time.Time `json:"time"`
-    Latitude  float64   `json:"latitude"`
-    Longitude float64   `json:"longitude"`
-    Depth     float64   `json:"depth"`
-    Magnitude float64   `json:"magnitude"`
-    Place     string    `json:"place"`
-    Alert     string    `json:"alert"`
-    Tsunami   int       `json:"tsunami"`
-    URL       string    `json:"url"`
+    Id            int       `json:"id"`
+    EventId       string    `json:"event_id"`
+    Time          time.Time `json:"time"`
+    Latitude      float64   `json:"latitude"`
+    Longitude     float64   `json:"longitude"`
+    Depth         float64   `json:"depth"`
+    Magnitude     float64   `json:"magnitude"`
+    MagnitudeType string    `json:"magnitude_type"`
+    Place         string    `json:"place"`
+    Alert         string    `json:"alert"`
+    Tsunami       int       `json:"tsunami"`
+    URL           string    `json:"url"`
+    ClusterId     *int      `json:"cluster_id,omitempty"`
+    Role          string    `json:"role,omitempty"`
+    DistanceKm    *float64  `json:"distance_km,omitempty"`
+    Bearing       *float64  `json:"bearing,omitempty"`
 }
 
 func main() {
+	// Run the server unless a subcommand is given
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch cmd {
+	case "serve":
+		err = runServe(args)
+	case "migrate":
+		err = runMigrate(args)
+	case "import":
+		err = runImport(args)
+	case "stats":
+		err = runStats(args)
+	case "decluster":
+		err = runDecluster(args)
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
+func runServe(args []string) error {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080" // Default to 8000 if no PORT variable is set
 	}
 
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.StringVar(&port, "port", port, "port to listen on")
+	databaseURL := flags.String("database-url", os.Getenv("DATABASE_URL"), "Postgres connection string")
+	flags.Parse(args)
+
 	// Connect to the database
-	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	db, err := sql.Open("postgres", *databaseURL)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer db.Close()
 
 	// Ensure tables are created
 	initializeDatabase(db)
 
+	// Start polling the earthquake feed in the background if one is configured
+	poller, err := newFeedPollerFromEnv(db)
+	if err != nil {
+		return err
+	}
+	if poller != nil {
+		go poller.run(context.Background())
+	}
+
 	// Create the main router
 	router := mux.NewRouter()
 
@@ -82,6 +135,11 @@ func main() {
 	router.HandleFunc("/sign-up", handleSignUp(db)).Methods("POST")
 	router.HandleFunc("/verify-token", handleVerifyToken()).Methods("POST")
 
+	// FDSN event web service, public so standard seismology clients can use it
+	router.HandleFunc("/fdsnws/event/1/query", handleFDSNQuery(db)).Methods("GET")
+	router.HandleFunc("/fdsnws/event/1/version", handleFDSNVersion()).Methods("GET")
+	router.HandleFunc("/fdsnws/event/1/application.wadl", handleFDSNWADL()).Methods("GET")
+
 	// Private routes (require authentication)
 	privateRouter := router.PathPrefix("/api/go").Subrouter()
 	privateRouter.Use(authMiddleware)
@@ -100,13 +158,36 @@ func main() {
 	privateRouter.HandleFunc("/preferences/{id}", updatePreference(db)).Methods("PUT")
 	privateRouter.HandleFunc("/preferences/{id}", deletePreference(db)).Methods("DELETE")
 	privateRouter.HandleFunc("/earthquakes", getEarthquakes(db)).Methods("GET")
+	privateRouter.HandleFunc("/earthquakes/search", getEarthquakes(db)).Methods("POST")
+	privateRouter.HandleFunc("/earthquakes/stats/gutenberg-richter", getGutenbergRichter(db)).Methods("GET")
+	privateRouter.HandleFunc("/earthquakes/stats/timeseries", getTimeSeries(db)).Methods("GET")
+	privateRouter.HandleFunc("/earthquakes/stats/rate-change", getRateChange(db)).Methods("GET")
+	privateRouter.HandleFunc("/earthquakes/grid", getEarthquakeGrid(db)).Methods("GET")
+	privateRouter.HandleFunc("/earthquakes/clusters", getEarthquakeClusters(db)).Methods("GET")
+	// Registered last so the fixed /earthquakes/... paths above take precedence
+	privateRouter.HandleFunc("/earthquakes/{id}", getEarthquake(db)).Methods("GET")
+	privateRouter.HandleFunc("/earthquakes/{id}/omori", getOmoriFit(db)).Methods("GET")
+	privateRouter.HandleFunc("/earthquakes/{id}/shaking", getSiteShaking(db)).Methods("GET", "POST")
+	privateRouter.HandleFunc("/earthquakes/{id}/shakemap", getShakeMap(db)).Methods("GET")
+
+	// Region routes
+	privateRouter.HandleFunc("/regions", getRegions(db)).Methods("GET")
+	privateRouter.HandleFunc("/regions", createRegion(db)).Methods("POST")
+	privateRouter.HandleFunc("/regions/{id}", getRegion(db)).Methods("GET")
+	privateRouter.HandleFunc("/regions/{id}", deleteRegion(db)).Methods("DELETE")
+
+	// Vector tile routes, map clients send the token with each tile request
+	privateRouter.HandleFunc("/tiles/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.mvt", handleEarthquakeTile(db)).Methods("GET")
+
+	// Ingestion routes
+	privateRouter.HandleFunc("/ingest/status", getIngestStatus(poller)).Methods("GET")
 
 	// Wrap the main router with middlewares
 	corsRouter := enableCORS(jsonContentTypeMiddleware(router))
 
 	// Start the server
 	log.Printf("Server running on port %s...", port)
-	log.Fatal(http.ListenAndServe(":"+port, corsRouter))
+	return http.ListenAndServe(":"+port, corsRouter)
 }
 
 func initializeDatabase(db *sql.DB) error {
@@ -133,15 +214,33 @@ func initializeDatabase(db *sql.DB) error {
 		time_end TIMESTAMP DEFAULT now(),
 		magnitude_min FLOAT DEFAULT 0,
 		magnitude_max FLOAT DEFAULT 10,
-		longitude_min FLOAT DEFAULT -180,
+		longitude_min FLOAT DEFAULT -180, -- greater than longitude_max when crossing the antimeridian
 		longitude_max FLOAT DEFAULT 180,
 		latitude_min FLOAT DEFAULT -90,
-		latitude_max FLOAT DEFAULT 90
+		latitude_max FLOAT DEFAULT 90,
+		region JSONB
 	)`)
 	if err != nil {
 		log.Fatalf("Error creating preferences table: %v", err)
 	}
 
+	_, err = db.Exec(`ALTER TABLE preferences ADD COLUMN IF NOT EXISTS region JSONB`)
+	if err != nil {
+		log.Fatalf("Error migrating preferences table: %v", err)
+	}
+
+	// Create the regions table if it doesn't exist
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS regions (
+		id SERIAL PRIMARY KEY,
+		user_id INT REFERENCES users(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		geometry JSONB NOT NULL
+	)`)
+	if err != nil {
+		log.Fatalf("Error creating regions table: %v", err)
+	}
+
     // Create the earthquakes table if it doesn't exist
     _, err = db.Exec(`
     CREATE TABLE IF NOT EXISTS earthquakes (
@@ -154,83 +253,64 @@ func initializeDatabase(db *sql.DB) error {
         place TEXT,
         alert TEXT,
         tsunami INT,
-        url TEXT
+        url TEXT,
+        event_id TEXT UNIQUE,
+        magnitude_type TEXT,
+        cluster_id INT,
+        role TEXT
     )`)
     if err != nil {
         log.Fatalf("Error creating earthquakes table: %v", err)
     }
 
-    return nil
-
-}
-
-
-
-func loadEarthquakeData(db *sql.DB, filePath string) error {
-    file, err := os.Open(filePath)
+    // Tables created before event ids, magnitude types and declustering were
+    // tracked need the columns and the event id's unique index
+    _, err = db.Exec(`
+    ALTER TABLE earthquakes ADD COLUMN IF NOT EXISTS event_id TEXT;
+    ALTER TABLE earthquakes ADD COLUMN IF NOT EXISTS magnitude_type TEXT;
+    ALTER TABLE earthquakes ADD COLUMN IF NOT EXISTS cluster_id INT;
+    ALTER TABLE earthquakes ADD COLUMN IF NOT EXISTS role TEXT`)
     if err != nil {
-        return err
+        log.Fatalf("Error migrating earthquakes table: %v", err)
     }
-    defer file.Close()
 
-    reader := csv.NewReader(file)
-    records, err := reader.ReadAll()
+    // Give rows loaded before event ids the id in their USGS url, so the next
+    // import updates them instead of adding a copy. A legacy row whose id is
+    // already taken, by a row imported since or a later legacy row, is a
+    // duplicate and is dropped before the unique index is built.
+    _, err = db.Exec(`
+    WITH legacy AS (
+        SELECT id, NULLIF(` + eventIDFromURLSQL + `, '') AS event_id
+        FROM earthquakes WHERE event_id IS NULL
+    )
+    DELETE FROM earthquakes WHERE id IN (
+        SELECT l.id FROM legacy l
+        WHERE EXISTS (SELECT 1 FROM earthquakes e WHERE e.event_id = l.event_id)
+           OR EXISTS (SELECT 1 FROM legacy o WHERE o.event_id = l.event_id AND o.id > l.id)
+    );
+    UPDATE earthquakes SET event_id = NULLIF(` + eventIDFromURLSQL + `, '')
+    WHERE event_id IS NULL;
+    CREATE UNIQUE INDEX IF NOT EXISTS earthquakes_event_id_key ON earthquakes (event_id)`)
     if err != nil {
-        return err
+        log.Fatalf("Error backfilling earthquake event ids: %v", err)
     }
 
-    // Skip the header row
-    for i, record := range records[1:] {
-        timeUnix, err := strconv.ParseFloat(record[1], 64)
-        if err != nil {
-            log.Printf("Error parsing time for record %d: %v", i, err)
-            continue
-        }
-        time := time.Unix(int64(timeUnix/1000), 0)
-        latitude, err := strconv.ParseFloat(record[2], 64)
-        if err != nil {
-            log.Printf("Error parsing latitude for record %d: %v", i, err)
-            continue
-        }
-        longitude, err := strconv.ParseFloat(record[3], 64)
-        if err != nil {
-            log.Printf("Error parsing longitude for record %d: %v", i, err)
-            continue
-        }
-        depth, err := strconv.ParseFloat(record[4], 64)
-        if err != nil {
-            log.Printf("Error parsing depth for record %d: %v", i, err)
-            continue
-        }
-        magnitude, err := strconv.ParseFloat(record[5], 64)
-        if err != nil {
-            log.Printf("Error parsing magnitude for record %d: %v", i, err)
-            continue
-        }
-        place := record[6]
-        alert := record[7]
-        tsunami, err := strconv.Atoi(record[8])
-        if err != nil {
-            log.Printf("Error parsing tsunami for record %d: %v", i, err)
-            continue
-        }
-        url := record[9]
-
-        _, err = db.Exec(`
-        INSERT INTO earthquakes (time, latitude, longitude, depth, magnitude, place, alert, tsunami, url)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-        ON CONFLICT DO NOTHING`,
-            time, latitude, longitude, depth, magnitude, place, alert, tsunami, url)
-        if err != nil {
-            log.Printf("Error inserting record %d: %v", i, err)
-        }
+    // Keyset pagination orders by one of these columns and then id, so each
+    // page is an index range scan rather than a sort of the whole table
+    _, err = db.Exec(`
+    CREATE INDEX IF NOT EXISTS earthquakes_time_id_idx ON earthquakes (time, id);
+    CREATE INDEX IF NOT EXISTS earthquakes_magnitude_id_idx ON earthquakes (magnitude, id);
+    CREATE INDEX IF NOT EXISTS earthquakes_depth_id_idx ON earthquakes (depth, id)`)
+    if err != nil {
+        log.Fatalf("Error indexing earthquakes table: %v", err)
     }
 
-    log.Println("Earthquake data loaded successfully")
     return nil
+
 }
 
 
+
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tokenString := r.Header.Get("Authorization")
@@ -500,120 +580,6 @@ func getUsers(db *sql.DB) http.HandlerFunc {
 		json.NewEncoder(w).Encode(users)
 	}
 }
-func getEarthquakes(db *sql.DB) http.HandlerFunc {
-    return func(w http.ResponseWriter, r *http.Request) {
-        userID, err := getUserIDFromContext(r.Context())
-        if err != nil {
-            log.Println("Unauthorized request")
-            http.Error(w, "Unauthorized", http.StatusUnauthorized)
-            return
-        }
-
-        log.Println("Fetching earthquakes for user ID:", userID)
-
-        // Parse query parameters
-        query := r.URL.Query()
-        var conditions []string
-        var args []interface{}
-        argID := 1
-
-        if val, ok := query["time_start"]; ok {
-            timeStart, err := time.Parse(time.RFC3339, val[0])
-            if err != nil {
-                log.Println("Invalid time_start format:", val[0])
-                http.Error(w, "Invalid time_start format", http.StatusBadRequest)
-                return
-            }
-            log.Println("Parsed time_start:", timeStart)
-            conditions = append(conditions, "time >= $"+strconv.Itoa(argID))
-            args = append(args, timeStart)
-            argID++
-        }
-        if val, ok := query["time_end"]; ok {
-            timeEnd, err := time.Parse(time.RFC3339, val[0])
-            if err != nil {
-                log.Println("Invalid time_end format:", val[0])
-                http.Error(w, "Invalid time_end format", http.StatusBadRequest)
-                return
-            }
-            log.Println("Parsed time_end:", timeEnd)
-            conditions = append(conditions, "time <= $"+strconv.Itoa(argID))
-            args = append(args, timeEnd)
-            argID++
-        }
-        if val, ok := query["depth_min"]; ok {
-            conditions = append(conditions, "depth >= $"+strconv.Itoa(argID))
-            args = append(args, val[0])
-            argID++
-        }
-        if val, ok := query["depth_max"]; ok {
-            conditions = append(conditions, "depth <= $"+strconv.Itoa(argID))
-            args = append(args, val[0])
-            argID++
-        }
-        if val, ok := query["magnitude_min"]; ok {
-            conditions = append(conditions, "magnitude >= $"+strconv.Itoa(argID))
-            args = append(args, val[0])
-            argID++
-        }
-        if val, ok := query["magnitude_max"]; ok {
-            conditions = append(conditions, "magnitude <= $"+strconv.Itoa(argID))
-            args = append(args, val[0])
-            argID++
-        }
-        if val, ok := query["longitude_min"]; ok {
-            conditions = append(conditions, "longitude >= $"+strconv.Itoa(argID))
-            args = append(args, val[0])
-            argID++
-        }
-        if val, ok := query["longitude_max"]; ok {
-            conditions = append(conditions, "longitude <= $"+strconv.Itoa(argID))
-            args = append(args, val[0])
-            argID++
-        }
-        if val, ok := query["latitude_min"]; ok {
-            conditions = append(conditions, "latitude >= $"+strconv.Itoa(argID))
-            args = append(args, val[0])
-            argID++
-        }
-        if val, ok := query["latitude_max"]; ok {
-            conditions = append(conditions, "latitude <= $"+strconv.Itoa(argID))
-            args = append(args, val[0])
-            argID++
-        }
-
-        queryString := "SELECT id, time, latitude, longitude, depth, magnitude, place, alert, tsunami, url FROM earthquakes"
-        if len(conditions) > 0 {
-            queryString += " WHERE " + strings.Join(conditions, " AND ")
-        }
-
-        log.Println("Executing query:", queryString, "with args:", args)
-
-        rows, err := db.Query(queryString, args...)
-        if err != nil {
-            log.Println("Error executing query:", err)
-            http.Error(w, "Database query error", http.StatusInternalServerError)
-            return
-        }
-        defer rows.Close()
-
-        earthquakes := []Earthquake{}
-        for rows.Next() {
-            var e Earthquake
-            if err := rows.Scan(&e.Id, &e.Time, &e.Latitude, &e.Longitude, &e.Depth, &e.Magnitude, &e.Place, &e.Alert, &e.Tsunami, &e.URL); err != nil {
-                log.Println("Error scanning row:", err)
-                continue
-            }
-            earthquakes = append(earthquakes, e)
-        }
-
-        log.Println("Retrieved", len(earthquakes), "earthquakes")
-
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(earthquakes)
-    }
-}
-
 // get user by id
 func getUser(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -752,9 +718,9 @@ func createPreference(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Read the raw body for debugging
-		body, err := io.ReadAll(r.Body)
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAreaBytes))
 		if err != nil {
-			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			http.Error(w, "Failed to read request body", bodyStatus(err))
 			fmt.Println("Error reading request body:", err)
 			return
 		}
@@ -770,10 +736,16 @@ func createPreference(db *sql.DB) http.HandlerFunc {
 
 		fmt.Println("Decoded Preference struct:", p)
 
+		if err := validateRegion(p.Region); err != nil {
+			http.Error(w, "Invalid region: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.LongitudeMin, p.LongitudeMax = normalizeLongitudeRange(p.LongitudeMin, p.LongitudeMax)
+
 		err = db.QueryRow(`
-        INSERT INTO preferences (user_id, depth_min, depth_max, time_start, time_end, magnitude_min, magnitude_max, longitude_min, longitude_max, latitude_min, latitude_max)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
-			userID, p.DepthMin, p.DepthMax, p.TimeStart, p.TimeEnd, p.MagnitudeMin, p.MagnitudeMax, p.LongitudeMin, p.LongitudeMax, p.LatitudeMin, p.LatitudeMax,
+        INSERT INTO preferences (user_id, depth_min, depth_max, time_start, time_end, magnitude_min, magnitude_max, longitude_min, longitude_max, latitude_min, latitude_max, region)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`,
+			userID, p.DepthMin, p.DepthMax, p.TimeStart, p.TimeEnd, p.MagnitudeMin, p.MagnitudeMax, p.LongitudeMin, p.LongitudeMax, p.LatitudeMin, p.LatitudeMax, regionParam(p.Region),
 		).Scan(&p.Id)
 		if err != nil {
 			log.Fatal(err)
@@ -791,7 +763,10 @@ func getPreferences(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		rows, err := db.Query("SELECT * FROM preferences WHERE user_id = $1", userID)
+		rows, err := db.Query(`
+            SELECT id, user_id, depth_min, depth_max, time_start, time_end, magnitude_min, magnitude_max, longitude_min, longitude_max, latitude_min, latitude_max, region
+            FROM preferences
+            WHERE user_id = $1`, userID)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -800,9 +775,11 @@ func getPreferences(db *sql.DB) http.HandlerFunc {
 		prefs := []Preference{}
 		for rows.Next() {
 			var p Preference
-			if err := rows.Scan(&p.Id, &p.UserId, &p.DepthMin, &p.DepthMax, &p.TimeStart, &p.TimeEnd, &p.MagnitudeMin, &p.MagnitudeMax, &p.LongitudeMin, &p.LongitudeMax, &p.LatitudeMin, &p.LatitudeMax); err != nil {
+			var region []byte
+			if err := rows.Scan(&p.Id, &p.UserId, &p.DepthMin, &p.DepthMax, &p.TimeStart, &p.TimeEnd, &p.MagnitudeMin, &p.MagnitudeMax, &p.LongitudeMin, &p.LongitudeMax, &p.LatitudeMin, &p.LatitudeMax, &region); err != nil {
 				log.Fatal(err)
 			}
+			p.Region = region
 			prefs = append(prefs, p)
 		}
 
@@ -825,16 +802,18 @@ func getPreference(db *sql.DB) http.HandlerFunc {
 		id := vars["id"]
 
 		var p Preference
+		var region []byte
 		err = db.QueryRow(`
-            SELECT id, user_id, depth_min, depth_max, time_start, time_end, magnitude_min, magnitude_max, longitude_min, longitude_max, latitude_min, latitude_max 
+            SELECT id, user_id, depth_min, depth_max, time_start, time_end, magnitude_min, magnitude_max, longitude_min, longitude_max, latitude_min, latitude_max, region
             FROM preferences 
             WHERE id = $1 AND user_id = $2`, id, userID).Scan(
-			&p.Id, &p.UserId, &p.DepthMin, &p.DepthMax, &p.TimeStart, &p.TimeEnd, &p.MagnitudeMin, &p.MagnitudeMax, &p.LongitudeMin, &p.LongitudeMax, &p.LatitudeMin, &p.LatitudeMax,
+			&p.Id, &p.UserId, &p.DepthMin, &p.DepthMax, &p.TimeStart, &p.TimeEnd, &p.MagnitudeMin, &p.MagnitudeMax, &p.LongitudeMin, &p.LongitudeMax, &p.LatitudeMin, &p.LatitudeMax, &region,
 		)
 		if err != nil {
 			http.Error(w, "Preference not found", http.StatusNotFound)
 			return
 		}
+		p.Region = region
 
 		json.NewEncoder(w).Encode(p)
 	}
@@ -855,18 +834,23 @@ func updatePreference(db *sql.DB) http.HandlerFunc {
 		fmt.Println("Update User ID: ", userID)
 
 		var p Preference
-		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAreaBytes)).Decode(&p); err != nil {
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
+		}
+		if err := validateRegion(p.Region); err != nil {
+			http.Error(w, "Invalid region: "+err.Error(), http.StatusBadRequest)
 			return
 		}
+		p.LongitudeMin, p.LongitudeMax = normalizeLongitudeRange(p.LongitudeMin, p.LongitudeMax)
 
 		_, err = db.Exec(`
             UPDATE preferences 
             SET depth_min = $1, depth_max = $2, time_start = $3, time_end = $4, magnitude_min = $5, magnitude_max = $6, 
-                longitude_min = $7, longitude_max = $8, latitude_min = $9, latitude_max = $10 
-            WHERE id = $11 AND user_id = $12`,
+                longitude_min = $7, longitude_max = $8, latitude_min = $9, latitude_max = $10, region = $11
+            WHERE id = $12 AND user_id = $13`,
 			p.DepthMin, p.DepthMax, p.TimeStart, p.TimeEnd, p.MagnitudeMin, p.MagnitudeMax,
-			p.LongitudeMin, p.LongitudeMax, p.LatitudeMin, p.LatitudeMax, id, userID,
+			p.LongitudeMin, p.LongitudeMax, p.LatitudeMin, p.LatitudeMax, regionParam(p.Region), id, userID,
 		)
 		if err != nil {
 			log.Println("Error updating preference:", err)
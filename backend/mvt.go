@@ -0,0 +1,331 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Vector tile parameters. Points are drawn in a square of mvtExtent units
+// per tile and features up to mvtBuffer units outside it are kept, so
+// symbols near a tile edge are not clipped by the neighbouring tile.
+const (
+	mvtExtent  = 4096
+	mvtBuffer  = 64
+	mvtMaxZoom = 22
+
+	// Below mvtClusterZoom, earthquakes within mvtClusterCell tile units of
+	// each other are merged into a single cluster point
+	mvtClusterZoom = 8
+	mvtClusterCell = 128
+
+	// mvtMaxEarthquakes caps the rows read for one tile, keeping the
+	// largest earthquakes when a low zoom tile covers more
+	mvtMaxEarthquakes = 20000
+
+	mvtLayerName   = "earthquakes"
+	mvtContentType = "application/vnd.mapbox-vector-tile"
+)
+
+// maxMercatorLatitude is the latitude where web mercator tiles end
+var maxMercatorLatitude = degrees(math.Atan(math.Sinh(math.Pi)))
+
+// tileLongitude and tileLatitude give the west and north edges of tile x, y
+// at zoom z, allowing fractional tile coordinates
+func tileLongitude(x float64, z int) float64 {
+	return x/math.Exp2(float64(z))*360 - 180
+}
+
+func tileLatitude(y float64, z int) float64 {
+	return degrees(math.Atan(math.Sinh(math.Pi * (1 - 2*y/math.Exp2(float64(z))))))
+}
+
+// tilePoint projects a point to web mercator tile units relative to the
+// north-west corner of tile x, y at zoom z
+func tilePoint(lon, lat float64, z, x, y int) (int64, int64) {
+	lat = math.Max(-maxMercatorLatitude, math.Min(maxMercatorLatitude, lat))
+	n := math.Exp2(float64(z))
+	px := (lon + 180) / 360 * n
+	py := (1 - math.Log(math.Tan(radians(lat))+1/math.Cos(radians(lat)))/math.Pi) / 2 * n
+	return int64(math.Round((px - float64(x)) * mvtExtent)), int64(math.Round((py - float64(y)) * mvtExtent))
+}
+
+// protoBuffer appends protocol buffer wire format fields
+type protoBuffer []byte
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *protoBuffer) key(field, wireType int) {
+	b.varint(uint64(field<<3 | wireType))
+}
+
+func (b *protoBuffer) uintField(field int, v uint64) {
+	b.key(field, 0)
+	b.varint(v)
+}
+
+func (b *protoBuffer) bytesField(field int, v []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) doubleField(field int, v float64) {
+	b.key(field, 1)
+	bits := math.Float64bits(v)
+	for i := 0; i < 8; i++ {
+		*b = append(*b, byte(bits>>(8*i)))
+	}
+}
+
+// packedField writes repeated uint32 values in packed encoding
+func (b *protoBuffer) packedField(field int, values []uint32) {
+	var packed protoBuffer
+	for _, v := range values {
+		packed.varint(uint64(v))
+	}
+	b.bytesField(field, packed)
+}
+
+func zigzag(v int64) uint32 {
+	return uint32((v << 1) ^ (v >> 63))
+}
+
+// mvtLayer builds a single point layer of a Mapbox Vector Tile, version 2.
+// Keys and values are shared between features through lookup tables.
+type mvtLayer struct {
+	features   protoBuffer
+	keys       []string
+	keyIndex   map[string]uint32
+	values     []protoBuffer
+	valueIndex map[string]uint32
+}
+
+func newMVTLayer() *mvtLayer {
+	return &mvtLayer{keyIndex: map[string]uint32{}, valueIndex: map[string]uint32{}}
+}
+
+func (l *mvtLayer) keyTag(k string) uint32 {
+	i, ok := l.keyIndex[k]
+	if !ok {
+		i = uint32(len(l.keys))
+		l.keys = append(l.keys, k)
+		l.keyIndex[k] = i
+	}
+	return i
+}
+
+// valueTag returns the index of a string, float64, int, int64 or bool value
+func (l *mvtLayer) valueTag(v interface{}) uint32 {
+	id := fmt.Sprintf("%T:%v", v, v)
+	if i, ok := l.valueIndex[id]; ok {
+		return i
+	}
+	var value protoBuffer
+	switch v := v.(type) {
+	case string:
+		value.bytesField(1, []byte(v))
+	case float64:
+		value.doubleField(3, v)
+	case int:
+		value.uintField(4, uint64(v))
+	case int64:
+		value.uintField(4, uint64(v))
+	case bool:
+		if v {
+			value.uintField(7, 1)
+		} else {
+			value.uintField(7, 0)
+		}
+	}
+	i := uint32(len(l.values))
+	l.values = append(l.values, value)
+	l.valueIndex[id] = i
+	return i
+}
+
+// addPoint adds a point feature at tile coordinates x, y. An id of zero is
+// left out, as clusters have none.
+func (l *mvtLayer) addPoint(id uint64, x, y int64, properties [][2]interface{}) {
+	tags := make([]uint32, 0, 2*len(properties))
+	for _, p := range properties {
+		tags = append(tags, l.keyTag(p[0].(string)), l.valueTag(p[1]))
+	}
+
+	var feature protoBuffer
+	if id != 0 {
+		feature.uintField(1, id)
+	}
+	feature.packedField(2, tags)
+	feature.uintField(3, 1) // POINT
+	// A single MoveTo command with a count of one
+	feature.packedField(4, []uint32{1&0x7 | 1<<3, zigzag(x), zigzag(y)})
+	l.features.bytesField(2, feature)
+}
+
+// tile encodes the layer as a complete tile, or returns nil if it is empty
+func (l *mvtLayer) tile() []byte {
+	if len(l.features) == 0 {
+		return nil
+	}
+	var layer protoBuffer
+	layer.uintField(15, 2)
+	layer.bytesField(1, []byte(mvtLayerName))
+	layer = append(layer, l.features...)
+	for _, k := range l.keys {
+		layer.bytesField(3, []byte(k))
+	}
+	for _, v := range l.values {
+		layer.bytesField(4, v)
+	}
+	layer.uintField(5, mvtExtent)
+
+	var tile protoBuffer
+	tile.bytesField(3, layer)
+	return tile
+}
+
+func earthquakeProperties(e Earthquake) [][2]interface{} {
+	return [][2]interface{}{
+		{"event_id", e.EventId},
+		{"magnitude", e.Magnitude},
+		{"depth", e.Depth},
+		{"time", e.Time.UnixMilli()},
+		{"place", e.Place},
+	}
+}
+
+// mvtCluster collects the earthquakes falling in one cluster cell
+type mvtCluster struct {
+	first        Earthquake
+	sumX, sumY   int64
+	count        int
+	maxMagnitude float64
+}
+
+// serve earthquakes as Mapbox Vector Tiles with a single "earthquakes" point
+// layer. The getEarthquakes time, magnitude and depth filters apply; the
+// tile itself sets the area. At low zooms nearby earthquakes are clustered
+// into points carrying a point_count and their largest magnitude. At most
+// mvtMaxEarthquakes of the largest earthquakes are drawn in a tile.
+func handleEarthquakeTile(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := getUserIDFromContext(r.Context()); err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		z, errZ := strconv.Atoi(vars["z"])
+		x, errX := strconv.Atoi(vars["x"])
+		y, errY := strconv.Atoi(vars["y"])
+		n := 1 << uint(z)
+		if errZ != nil || errX != nil || errY != nil || z > mvtMaxZoom || x >= n || y >= n {
+			http.Error(w, "Invalid tile coordinates", http.StatusBadRequest)
+			return
+		}
+
+		filter, err := parseEarthquakeFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Query the tile bounds plus the buffer, clamped to the globe
+		buffer := float64(mvtBuffer) / mvtExtent
+		west := math.Max(-180, tileLongitude(float64(x)-buffer, z))
+		east := math.Min(180, tileLongitude(float64(x+1)+buffer, z))
+		north := tileLatitude(math.Max(0, float64(y)-buffer), z)
+		south := tileLatitude(math.Min(float64(n), float64(y+1)+buffer), z)
+		if y == 0 {
+			north = 90
+		}
+		if y == n-1 {
+			south = -90
+		}
+		filter.LongitudeMin, filter.LongitudeMax = &west, &east
+		filter.LatitudeMin, filter.LatitudeMax = &south, &north
+
+		filter.OrderBy, filter.Descending = "magnitude", true
+		filter.Limit = mvtMaxEarthquakes
+
+		layer := newMVTLayer()
+		clusters := map[[2]int64]*mvtCluster{}
+		var order [][2]int64
+		var points []Earthquake
+		err = streamEarthquakes(r.Context(), db, filter, func(e Earthquake) error {
+			if z >= mvtClusterZoom {
+				points = append(points, e)
+				return nil
+			}
+
+			px, py := tilePoint(e.Longitude, e.Latitude, z, x, y)
+
+			cell := [2]int64{
+				int64(math.Floor(float64(px) / mvtClusterCell)),
+				int64(math.Floor(float64(py) / mvtClusterCell)),
+			}
+			c, ok := clusters[cell]
+			if !ok {
+				c = &mvtCluster{first: e}
+				clusters[cell] = c
+				order = append(order, cell)
+			}
+			c.sumX += px
+			c.sumY += py
+			c.count++
+			c.maxMagnitude = math.Max(c.maxMagnitude, e.Magnitude)
+			return nil
+		})
+		if err != nil {
+			log.Println("Error building tile:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		// Features drawn later sit on top, so put the largest earthquakes last
+		for i := len(points) - 1; i >= 0; i-- {
+			px, py := tilePoint(points[i].Longitude, points[i].Latitude, z, x, y)
+			layer.addPoint(uint64(points[i].Id), px, py, earthquakeProperties(points[i]))
+		}
+		if len(order) > 0 {
+			sort.SliceStable(order, func(i, j int) bool {
+				return clusters[order[i]].maxMagnitude < clusters[order[j]].maxMagnitude
+			})
+			for _, cell := range order {
+				c := clusters[cell]
+				if c.count == 1 {
+					px, py := tilePoint(c.first.Longitude, c.first.Latitude, z, x, y)
+					layer.addPoint(uint64(c.first.Id), px, py, earthquakeProperties(c.first))
+					continue
+				}
+				layer.addPoint(0, c.sumX/int64(c.count), c.sumY/int64(c.count), [][2]interface{}{
+					{"cluster", true},
+					{"point_count", c.count},
+					{"magnitude", c.maxMagnitude},
+				})
+			}
+		}
+
+		w.Header().Set("Content-Type", mvtContentType)
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		tile := layer.tile()
+		if tile == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write(tile)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// minOmoriEvents is the fewest aftershocks an Omori-Utsu fit is attempted with
+const minOmoriEvents = 10
+
+// omoriForecastHorizons are the periods aftershock forecasts are given for
+var omoriForecastHorizons = []struct {
+	name string
+	days float64
+}{
+	{"day", 1},
+	{"week", 7},
+	{"month", 30},
+}
+
+// omoriUtsu is the modified Omori law, the aftershock rate
+// n(t) = K / (t + c)^p per day, t days after the mainshock
+type omoriUtsu struct {
+	K float64 `json:"k"`
+	C float64 `json:"c"`
+	P float64 `json:"p"`
+}
+
+func (o omoriUtsu) rate(t float64) float64 {
+	return o.K / math.Pow(t+o.C, o.P)
+}
+
+// expected is the expected number of aftershocks between s and t days
+func (o omoriUtsu) expected(s, t float64) float64 {
+	return o.K * omoriIntegral(o.C, o.P, s, t)
+}
+
+// omoriIntegral is the integral of (t + c)^-p from s to t
+func omoriIntegral(c, p, s, t float64) float64 {
+	if math.Abs(p-1) < 1e-9 {
+		return math.Log((t + c) / (s + c))
+	}
+	return (math.Pow(t+c, 1-p) - math.Pow(s+c, 1-p)) / (1 - p)
+}
+
+// fitOmoriUtsu finds the maximum likelihood K, c and p for aftershocks at
+// times ts observed from s to t days after the mainshock (Ogata, 1983). K
+// has a closed form given c and p, so only c and p are searched, by
+// Nelder-Mead over log c and p. It also returns the maximum log-likelihood.
+func fitOmoriUtsu(ts []float64, s, t float64) (omoriUtsu, float64) {
+	best := nelderMead(func(x []float64) float64 {
+		c, p := math.Exp(x[0]), x[1]
+		// Keep the search to physically plausible decay exponents
+		if p < 0.2 || p > 3 || c > t {
+			return math.Inf(1)
+		}
+		return -omoriLogLikelihood(ts, s, t, c, p)
+	}, []float64{math.Log(0.05), 1.1}, []float64{1, 0.2}, 500)
+
+	c, p := math.Exp(best[0]), best[1]
+	return omoriUtsu{K: float64(len(ts)) / omoriIntegral(c, p, s, t), C: c, P: p}, omoriLogLikelihood(ts, s, t, c, p)
+}
+
+// omoriLogLikelihood is the log-likelihood of aftershocks at times ts, seen
+// from s to t days, under the Omori-Utsu law with c and p and the K that
+// accounts for all of them
+func omoriLogLikelihood(ts []float64, s, t, c, p float64) float64 {
+	n := float64(len(ts))
+	sumLog := 0.0
+	for _, ti := range ts {
+		sumLog += math.Log(ti + c)
+	}
+	integral := omoriIntegral(c, p, s, t)
+	return n*math.Log(n/integral) - p*sumLog - n
+}
+
+// nelderMead minimizes f from x0 with the Nelder-Mead simplex method, using
+// step as the initial simplex size along each axis
+func nelderMead(f func([]float64) float64, x0, step []float64, iterations int) []float64 {
+	dim := len(x0)
+	simplex := make([][]float64, dim+1)
+	values := make([]float64, dim+1)
+	for i := range simplex {
+		simplex[i] = append([]float64(nil), x0...)
+		if i > 0 {
+			simplex[i][i-1] += step[i-1]
+		}
+		values[i] = f(simplex[i])
+	}
+
+	point := func(from, towards []float64, scale float64) []float64 {
+		x := make([]float64, dim)
+		for i := range x {
+			x[i] = from[i] + scale*(towards[i]-from[i])
+		}
+		return x
+	}
+
+	for iter := 0; iter < iterations; iter++ {
+		order := make([]int, dim+1)
+		for i := range order {
+			order[i] = i
+		}
+		sort.Slice(order, func(a, b int) bool { return values[order[a]] < values[order[b]] })
+		sorted, sortedValues := make([][]float64, dim+1), make([]float64, dim+1)
+		for i, o := range order {
+			sorted[i], sortedValues[i] = simplex[o], values[o]
+		}
+		simplex, values = sorted, sortedValues
+
+		if math.Abs(values[dim]-values[0]) < 1e-10 {
+			break
+		}
+
+		centroid := make([]float64, dim)
+		for _, x := range simplex[:dim] {
+			for i := range centroid {
+				centroid[i] += x[i] / float64(dim)
+			}
+		}
+
+		worst := simplex[dim]
+		reflected := point(centroid, worst, -1)
+		fr := f(reflected)
+		switch {
+		case fr < values[0]:
+			expanded := point(centroid, worst, -2)
+			if fe := f(expanded); fe < fr {
+				simplex[dim], values[dim] = expanded, fe
+			} else {
+				simplex[dim], values[dim] = reflected, fr
+			}
+		case fr < values[dim-1]:
+			simplex[dim], values[dim] = reflected, fr
+		default:
+			contracted := point(centroid, worst, 0.5)
+			if fc := f(contracted); fc < values[dim] {
+				simplex[dim], values[dim] = contracted, fc
+				continue
+			}
+			// Shrink towards the best point
+			for i := 1; i <= dim; i++ {
+				simplex[i] = point(simplex[0], simplex[i], 0.5)
+				values[i] = f(simplex[i])
+			}
+		}
+	}
+
+	best := 0
+	for i := range values {
+		if values[i] < values[best] {
+			best = i
+		}
+	}
+	return simplex[best]
+}
+
+// omoriRatePoint is one sample of a fitted aftershock rate curve
+type omoriRatePoint struct {
+	Days       float64   `json:"days"`
+	Time       time.Time `json:"time"`
+	RatePerDay float64   `json:"rate_per_day"`
+}
+
+// omoriForecast is the expected number of aftershocks in a coming period
+type omoriForecast struct {
+	Period    string    `json:"period"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Magnitude float64   `json:"magnitude"`
+	Expected  float64   `json:"expected"`
+}
+
+// fit the Omori-Utsu aftershock decay of a mainshock and forecast the number
+// of aftershocks to come. Aftershocks are taken from the mainshock's
+// Gardner-Knopoff window unless radius_km and days are given.
+func getOmoriFit(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := getUserIDFromContext(r.Context()); err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		mainshock, err := findEarthquake(r, db, mux.Vars(r)["id"])
+		if err == sql.ErrNoRows {
+			http.Error(w, "Earthquake not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Error fetching earthquake:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		query := r.URL.Query()
+		radiusKm, days := gardnerKnopoffWindow(mainshock.Magnitude)
+		params := map[string]*float64{}
+		for _, name := range []string{"radius_km", "days", "magnitude_min", "forecast_magnitude"} {
+			if params[name], err = floatParam(query, name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := params["radius_km"]; v != nil {
+			if *v <= 0 {
+				http.Error(w, "Invalid radius_km value", http.StatusBadRequest)
+				return
+			}
+			radiusKm = *v
+		}
+		if v := params["days"]; v != nil {
+			if *v <= 0 {
+				http.Error(w, "Invalid days value", http.StatusBadRequest)
+				return
+			}
+			days = *v
+		}
+
+		// Observe until the end of the window, or until now if it is still open
+		end := mainshock.Time.Add(time.Duration(days * 24 * float64(time.Hour)))
+		if now := time.Now(); end.After(now) {
+			end = now
+		}
+		f := earthquakeFilter{
+			TimeStart:    &mainshock.Time,
+			TimeEnd:      &end,
+			Latitude:     &mainshock.Latitude,
+			Longitude:    &mainshock.Longitude,
+			MaxRadiusKm:  &radiusKm,
+			MagnitudeMin: params["magnitude_min"],
+			OrderBy:      "time",
+		}
+		var aftershocks []Earthquake
+		err = streamEarthquakes(r.Context(), db, f, func(e Earthquake) error {
+			if e.Id != mainshock.Id && e.Time.After(mainshock.Time) {
+				aftershocks = append(aftershocks, e)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("Error fetching aftershocks:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		// Fit above the magnitude of completeness, estimated unless given
+		magnitudes := make([]float64, len(aftershocks))
+		for i, e := range aftershocks {
+			magnitudes[i] = e.Magnitude
+		}
+		bins, err := magnitudeDistribution(magnitudes, defaultMagnitudeBin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		gr := gutenbergRichter{BinWidth: defaultMagnitudeBin, McMethod: "maximum curvature", Bins: bins}
+		var mc float64
+		switch {
+		case params["magnitude_min"] != nil:
+			mc = *params["magnitude_min"]
+			gr.McMethod = "fixed"
+		case len(gr.Bins) > 0:
+			mc = maxCurvatureMc(gr.Bins)
+		}
+		gr.Mc = &mc
+		fitGutenbergRichter(&gr, magnitudes, mc)
+
+		var ts []float64
+		for _, e := range aftershocks {
+			if e.Magnitude >= mc-defaultMagnitudeBin/2 {
+				ts = append(ts, daysBetween(mainshock.Time, e.Time))
+			}
+		}
+		if len(ts) < minOmoriEvents {
+			http.Error(w, fmt.Sprintf("Too few aftershocks to fit, need at least %d above the magnitude of completeness", minOmoriEvents), http.StatusUnprocessableEntity)
+			return
+		}
+
+		observed := daysBetween(mainshock.Time, end)
+		omori, logLikelihood := fitOmoriUtsu(ts, 0, observed)
+
+		// Sample the rate curve at logarithmic intervals through the forecasts
+		horizon := observed + omoriForecastHorizons[len(omoriForecastHorizons)-1].days
+		first := math.Max(ts[0], 1e-3)
+		curve := []omoriRatePoint{}
+		for i := 0; i <= 100; i++ {
+			t := first * math.Pow(horizon/first, float64(i)/100)
+			curve = append(curve, omoriRatePoint{
+				Days:       t,
+				Time:       mainshock.Time.Add(time.Duration(t * 24 * float64(time.Hour))),
+				RatePerDay: omori.rate(t),
+			})
+		}
+
+		// Scale counts above mc to the forecast magnitude with the b-value,
+		// falling back to b = 1 if it could not be estimated, in which case
+		// b_value is null
+		b := 1.0
+		if gr.BValue != nil {
+			b = *gr.BValue
+		}
+		forecastMagnitude := mc
+		if v := params["forecast_magnitude"]; v != nil {
+			forecastMagnitude = *v
+		}
+		scale := math.Pow(10, -b*(forecastMagnitude-mc))
+		forecasts := []omoriForecast{}
+		for _, h := range omoriForecastHorizons {
+			forecasts = append(forecasts, omoriForecast{
+				Period:    h.name,
+				Start:     end,
+				End:       end.Add(time.Duration(h.days * 24 * float64(time.Hour))),
+				Magnitude: forecastMagnitude,
+				Expected:  omori.expected(observed, observed+h.days) * scale,
+			})
+		}
+
+		json.NewEncoder(w).Encode(struct {
+			Mainshock     Earthquake       `json:"mainshock"`
+			RadiusKm      float64          `json:"radius_km"`
+			WindowEnd     time.Time        `json:"window_end"`
+			Mc            float64          `json:"mc"`
+			McMethod      string           `json:"mc_method"`
+			BValue        *float64         `json:"b_value"`
+			Count         int              `json:"count"`
+			Parameters    omoriUtsu        `json:"parameters"`
+			LogLikelihood float64          `json:"log_likelihood"`
+			Rate          []omoriRatePoint `json:"rate"`
+			Forecasts     []omoriForecast  `json:"forecasts"`
+		}{mainshock, radiusKm, end, mc, gr.McMethod, gr.BValue, len(ts), omori, logLikelihood, curve, forecasts})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// omoriSequence draws n aftershock times from 0 to t days that follow the
+// modified Omori law with the given c and p, by inverting its distribution
+func omoriSequence(rng *rand.Rand, n int, c, p, t float64) []float64 {
+	ts := make([]float64, n)
+	for i := range ts {
+		u := rng.Float64()
+		start, end := math.Pow(c, 1-p), math.Pow(t+c, 1-p)
+		ts[i] = math.Pow(start+u*(end-start), 1/(1-p)) - c
+	}
+	sort.Float64s(ts)
+	return ts
+}
+
+func TestFitOmoriUtsu(t *testing.T) {
+	const n, c, p, days = 3000, 0.05, 1.1, 100.0
+	ts := omoriSequence(rand.New(rand.NewSource(1)), n, c, p, days)
+
+	fit, logLikelihood := fitOmoriUtsu(ts, 0, days)
+	if math.Abs(fit.P-p) > 0.05 {
+		t.Errorf("p = %g, want %g ± 0.05", fit.P, p)
+	}
+	if fit.C < c/2 || fit.C > c*2 {
+		t.Errorf("c = %g, want within a factor of 2 of %g", fit.C, c)
+	}
+	// The fitted rate accounts for every observed aftershock
+	if got := fit.expected(0, days); math.Abs(got-n) > 1e-6*n {
+		t.Errorf("expected aftershocks over the window = %g, want %d", got, n)
+	}
+
+	// The fit maximizes the likelihood, so the true parameters do no better
+	if trueLogLikelihood := omoriLogLikelihood(ts, 0, days, c, p); trueLogLikelihood > logLikelihood+1e-6 {
+		t.Errorf("log-likelihood %g of the fit is below %g of the true parameters", logLikelihood, trueLogLikelihood)
+	}
+}
+
+func TestOmoriIntegralContinuousAtPOne(t *testing.T) {
+	const c, s, end = 0.05, 0.5, 30.0
+	atOne := omoriIntegral(c, 1, s, end)
+	if want := math.Log((end + c) / (s + c)); atOne != want {
+		t.Fatalf("omoriIntegral at p = 1 is %g, want %g", atOne, want)
+	}
+	for _, p := range []float64{1 - 1e-6, 1 - 1e-10, 1 + 1e-10, 1 + 1e-6} {
+		if got := omoriIntegral(c, p, s, end); math.Abs(got-atOne) > 1e-5*atOne {
+			t.Errorf("omoriIntegral at p = %v is %g, want about %g", p, got, atOne)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// feedPoller periodically ingests a USGS GeoJSON feed, only writing events
+// that are new or revised since the last event it has seen.
+type feedPoller struct {
+	db         *sql.DB
+	source     string
+	interval   time.Duration
+	maxBackoff time.Duration
+
+	mu     sync.Mutex
+	status pollStatus
+}
+
+type pollStatus struct {
+	Enabled             bool      `json:"enabled"`
+	Source              string    `json:"source,omitempty"`
+	Interval            string    `json:"interval,omitempty"`
+	Running             bool      `json:"running"`
+	LastRun             time.Time `json:"last_run"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastIngested        int       `json:"last_ingested"`
+	TotalIngested       int       `json:"total_ingested"`
+	HighWaterMark       time.Time `json:"high_water_mark"`
+	NextRun             time.Time `json:"next_run"`
+}
+
+// newFeedPollerFromEnv configures a poller from FEED_URL, FEED_POLL_INTERVAL
+// and FEED_MAX_BACKOFF. It returns nil when FEED_URL is not set.
+func newFeedPollerFromEnv(db *sql.DB) (*feedPoller, error) {
+	source := os.Getenv("FEED_URL")
+	if source == "" {
+		return nil, nil
+	}
+
+	interval, err := durationFromEnv("FEED_POLL_INTERVAL", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	maxBackoff, err := durationFromEnv("FEED_MAX_BACKOFF", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	return newFeedPoller(db, source, interval, maxBackoff), nil
+}
+
+func newFeedPoller(db *sql.DB, source string, interval, maxBackoff time.Duration) *feedPoller {
+	if maxBackoff < interval {
+		maxBackoff = interval
+	}
+	return &feedPoller{
+		db:         db,
+		source:     source,
+		interval:   interval,
+		maxBackoff: maxBackoff,
+		status: pollStatus{
+			Enabled:  true,
+			Source:   source,
+			Interval: interval.String(),
+		},
+	}
+}
+
+func durationFromEnv(key string, fallback time.Duration) (time.Duration, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s: must be positive", key)
+	}
+	return d, nil
+}
+
+// run polls until ctx is cancelled, backing off exponentially after failures
+func (p *feedPoller) run(ctx context.Context) {
+	log.Printf("Polling %s every %s", p.source, p.interval)
+	for {
+		delay := p.interval
+		if err := p.poll(); err != nil {
+			delay = p.backoff()
+			log.Printf("Error polling %s (retrying in %s): %v", p.source, delay, err)
+		}
+
+		p.mu.Lock()
+		p.status.NextRun = time.Now().Add(delay)
+		p.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff doubles the poll interval for every consecutive failure, up to maxBackoff
+func (p *feedPoller) backoff() time.Duration {
+	p.mu.Lock()
+	failures := p.status.ConsecutiveFailures
+	p.mu.Unlock()
+
+	delay := p.interval
+	for i := 0; i < failures && delay < p.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.maxBackoff {
+		delay = p.maxBackoff
+	}
+	return delay
+}
+
+// poll fetches the feed once and upserts events revised after the high-water mark
+func (p *feedPoller) poll() error {
+	p.mu.Lock()
+	p.status.Running = true
+	p.status.LastRun = time.Now()
+	hwm := p.status.HighWaterMark
+	p.mu.Unlock()
+
+	n, newHWM, err := p.fetchSince(hwm)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Running = false
+	if err != nil {
+		p.status.LastError = err.Error()
+		p.status.ConsecutiveFailures++
+		return err
+	}
+	p.status.LastError = ""
+	p.status.ConsecutiveFailures = 0
+	p.status.LastSuccess = p.status.LastRun
+	p.status.LastIngested = n
+	p.status.TotalIngested += n
+	p.status.HighWaterMark = newHWM
+	return nil
+}
+
+func (p *feedPoller) fetchSince(hwm time.Time) (int, time.Time, error) {
+	body, err := openFeed(p.source)
+	if err != nil {
+		return 0, hwm, err
+	}
+	defer body.Close()
+
+	events, err := parseGeoJSONFeed(body)
+	if err != nil {
+		return 0, hwm, fmt.Errorf("parsing feed %s: %w", p.source, err)
+	}
+
+	newHWM := hwm
+	var earthquakes []Earthquake
+	for _, ev := range events {
+		if !ev.Updated.After(hwm) {
+			continue
+		}
+		earthquakes = append(earthquakes, ev.Earthquake)
+		if ev.Updated.After(newHWM) {
+			newHWM = ev.Updated
+		}
+	}
+	if len(earthquakes) == 0 {
+		return 0, hwm, nil
+	}
+
+	n, err := upsertEarthquakes(p.db, earthquakes)
+	if err != nil {
+		return 0, hwm, err
+	}
+	log.Printf("Ingested %d new or updated earthquakes from %s", n, p.source)
+	return n, newHWM, nil
+}
+
+func (p *feedPoller) snapshot() pollStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// get the status of the background feed poller
+func getIngestStatus(p *feedPoller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := pollStatus{}
+		if p != nil {
+			status = p.snapshot()
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
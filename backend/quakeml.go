@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuakeML 1.2 namespaces, see https://quake.ethz.ch/quakeml/
+const (
+	quakemlNamespace    = "http://quakeml.org/xmlns/quakeml/1.2"
+	quakemlBEDNamespace = "http://quakeml.org/xmlns/bed/1.2"
+)
+
+// quakemlEvent is a QuakeML event. The catalog attributes are those of the
+// ANSS catalog namespace that USGS puts on events.
+type quakemlEvent struct {
+	PublicID             string               `xml:"publicID,attr"`
+	CatalogEventSource   string               `xml:"http://anss.org/xmlns/catalog/0.1 eventsource,attr,omitempty"`
+	CatalogEventID       string               `xml:"http://anss.org/xmlns/catalog/0.1 eventid,attr,omitempty"`
+	PreferredOriginID    string               `xml:"preferredOriginID,omitempty"`
+	PreferredMagnitudeID string               `xml:"preferredMagnitudeID,omitempty"`
+	Type                 string               `xml:"type,omitempty"`
+	Descriptions         []quakemlDescription `xml:"description"`
+	Origins              []quakemlOrigin      `xml:"origin"`
+	Magnitudes           []quakemlMagnitude   `xml:"magnitude"`
+}
+
+type quakemlDescription struct {
+	Text string `xml:"text"`
+	Type string `xml:"type,omitempty"`
+}
+
+type quakemlOrigin struct {
+	PublicID  string              `xml:"publicID,attr"`
+	Time      quakemlTimeQuantity `xml:"time"`
+	Latitude  quakemlRealQuantity `xml:"latitude"`
+	Longitude quakemlRealQuantity `xml:"longitude"`
+	Depth     quakemlRealQuantity `xml:"depth"`
+}
+
+type quakemlMagnitude struct {
+	PublicID string              `xml:"publicID,attr"`
+	Mag      quakemlRealQuantity `xml:"mag"`
+	Type     string              `xml:"type,omitempty"`
+	OriginID string              `xml:"originID,omitempty"`
+}
+
+type quakemlRealQuantity struct {
+	Value float64 `xml:"value"`
+}
+
+type quakemlTimeQuantity struct {
+	Value string `xml:"value"`
+}
+
+// parseQuakeML streams event elements out of a QuakeML document, using each
+// event's preferred origin and magnitude. Events lacking either are skipped.
+func parseQuakeML(r io.Reader) ([]Earthquake, error) {
+	decoder := xml.NewDecoder(r)
+
+	var earthquakes []Earthquake
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "event" {
+			continue
+		}
+
+		var ev quakemlEvent
+		if err := decoder.DecodeElement(&ev, &start); err != nil {
+			return nil, err
+		}
+
+		e, err := ev.earthquake()
+		if err != nil {
+			log.Printf("Skipping QuakeML event %s: %v", ev.PublicID, err)
+			continue
+		}
+		earthquakes = append(earthquakes, e)
+	}
+
+	return earthquakes, nil
+}
+
+func (ev quakemlEvent) earthquake() (Earthquake, error) {
+	if len(ev.Origins) == 0 {
+		return Earthquake{}, fmt.Errorf("no origin")
+	}
+	if len(ev.Magnitudes) == 0 {
+		return Earthquake{}, fmt.Errorf("no magnitude")
+	}
+
+	origin := ev.Origins[0]
+	for _, o := range ev.Origins {
+		if o.PublicID == ev.PreferredOriginID {
+			origin = o
+		}
+	}
+	magnitude := ev.Magnitudes[0]
+	for _, m := range ev.Magnitudes {
+		if m.PublicID == ev.PreferredMagnitudeID {
+			magnitude = m
+		}
+	}
+
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(origin.Time.Value))
+	if err != nil {
+		return Earthquake{}, fmt.Errorf("invalid origin time %q", origin.Time.Value)
+	}
+
+	e := Earthquake{
+		EventId:       ev.eventID(),
+		Time:          t.UTC(),
+		Latitude:      origin.Latitude.Value,
+		Longitude:     origin.Longitude.Value,
+		Depth:         origin.Depth.Value / 1000, // QuakeML depths are in meters
+		Magnitude:     magnitude.Mag.Value,
+		MagnitudeType: magnitude.Type,
+	}
+	if len(ev.Descriptions) > 0 {
+		e.Place = ev.Descriptions[0].Text
+	}
+	if e.EventId == "" {
+		return Earthquake{}, fmt.Errorf("no event id")
+	}
+
+	return e, nil
+}
+
+// eventID is the upstream id of an event. FDSN services name events with a
+// query URL such as quakeml:earthquake.usgs.gov/fdsnws/event/1/query?eventid=us7000abcd,
+// so the ANSS catalog attributes come first, then the URL's eventid value,
+// then the last path segment of an smi: resource identifier.
+func (ev quakemlEvent) eventID() string {
+	if ev.CatalogEventSource != "" && ev.CatalogEventID != "" {
+		return ev.CatalogEventSource + ev.CatalogEventID
+	}
+	publicID := strings.TrimSpace(ev.PublicID)
+	if i := strings.Index(publicID, "?"); i >= 0 {
+		query, _ := url.ParseQuery(publicID[i+1:])
+		return query.Get("eventid")
+	}
+	if strings.HasPrefix(publicID, "smi:") {
+		return eventIDFromURL(publicID)
+	}
+	return ""
+}
+
+// ingestQuakeML loads a QuakeML file or URL into the earthquakes table
+func ingestQuakeML(db *sql.DB, source string) (int, error) {
+	body, err := openFeed(source)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	earthquakes, err := parseQuakeML(body)
+	if err != nil {
+		return 0, fmt.Errorf("parsing QuakeML %s: %w", source, err)
+	}
+
+	n, err := upsertEarthquakes(db, earthquakes)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Ingested %d earthquakes from %s", n, source)
+	return n, nil
+}
+
+// quakemlEventFor converts an earthquake to a QuakeML event with one origin
+// and magnitude, both marked as preferred
+func quakemlEventFor(e Earthquake) quakemlEvent {
+	id := e.EventId
+	if id == "" {
+		id = strconv.Itoa(e.Id)
+	}
+	originID := "smi:earthquake-visualizer/origin/" + id
+	magnitudeID := "smi:earthquake-visualizer/magnitude/" + id
+
+	ev := quakemlEvent{
+		PublicID:             "smi:earthquake-visualizer/event/" + id,
+		PreferredOriginID:    originID,
+		PreferredMagnitudeID: magnitudeID,
+		Type:                 "earthquake",
+		Origins: []quakemlOrigin{{
+			PublicID:  originID,
+			Time:      quakemlTimeQuantity{Value: e.Time.UTC().Format(time.RFC3339Nano)},
+			Latitude:  quakemlRealQuantity{Value: e.Latitude},
+			Longitude: quakemlRealQuantity{Value: e.Longitude},
+			Depth:     quakemlRealQuantity{Value: e.Depth * 1000},
+		}},
+		Magnitudes: []quakemlMagnitude{{
+			PublicID: magnitudeID,
+			Mag:      quakemlRealQuantity{Value: e.Magnitude},
+			Type:     e.MagnitudeType,
+			OriginID: originID,
+		}},
+	}
+	if e.Place != "" {
+		ev.Descriptions = []quakemlDescription{{Text: e.Place, Type: "region name"}}
+	}
+	return ev
+}
+
+// quakemlEncoder writes a QuakeML 1.2 document one event element at a time
+type quakemlEncoder struct {
+	w       io.Writer
+	encoder *xml.Encoder
+}
+
+func (q *quakemlEncoder) begin() error {
+	_, err := fmt.Fprintf(q.w, "%s<q:quakeml xmlns:q=%q xmlns=%q>\n"+
+		"  <eventParameters publicID=\"smi:earthquake-visualizer/eventParameters\">",
+		xml.Header, quakemlNamespace, quakemlBEDNamespace)
+	q.encoder = xml.NewEncoder(q.w)
+	q.encoder.Indent("    ", "  ")
+	return err
+}
+
+func (q *quakemlEncoder) encode(e Earthquake) error {
+	if err := q.encoder.EncodeElement(quakemlEventFor(e), xml.StartElement{Name: xml.Name{Local: "event"}}); err != nil {
+		return err
+	}
+	return q.encoder.Flush()
+}
+
+func (q *quakemlEncoder) end() error {
+	_, err := io.WriteString(q.w, "\n  </eventParameters>\n</q:quakeml>\n")
+	return err
+}
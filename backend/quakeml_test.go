@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseQuakeMLFromUSGS(t *testing.T) {
+	f, err := os.Open("testdata/usgs_quakeml.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	earthquakes, err := parseQuakeML(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(earthquakes) != 2 {
+		t.Fatalf("got %d earthquakes, want 2", len(earthquakes))
+	}
+
+	e := earthquakes[0]
+	if e.EventId != "us7000kufc" {
+		t.Errorf("event id %q, want us7000kufc", e.EventId)
+	}
+	if want := time.Date(2023, 11, 14, 11, 50, 12, 345e6, time.UTC); !e.Time.Equal(want) {
+		t.Errorf("time %s, want %s", e.Time, want)
+	}
+	if e.Latitude != 54.8912 || e.Longitude != -160.2143 || e.Depth != 35.4 {
+		t.Errorf("located at %g, %g, %g km", e.Latitude, e.Longitude, e.Depth)
+	}
+	if e.Magnitude != 4.7 || e.MagnitudeType != "mww" || e.Place != "54 km SSE of Sand Point, Alaska" {
+		t.Errorf("magnitude %g %s at %q", e.Magnitude, e.MagnitudeType, e.Place)
+	}
+	if earthquakes[1].EventId != "us7000kuf2" {
+		t.Errorf("second event id %q, want us7000kuf2", earthquakes[1].EventId)
+	}
+}
+
+func TestQuakeMLEventID(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   quakemlEvent
+		want string
+	}{
+		{
+			"catalog attributes",
+			quakemlEvent{PublicID: "quakeml:earthquake.usgs.gov/fdsnws/event/1/query?eventid=us7000kufc&format=quakeml", CatalogEventSource: "us", CatalogEventID: "7000kufc"},
+			"us7000kufc",
+		},
+		{
+			"eventid query value",
+			quakemlEvent{PublicID: "quakeml:earthquake.usgs.gov/fdsnws/event/1/query?eventid=nc73951234&format=quakeml"},
+			"nc73951234",
+		},
+		{
+			"IRIS query",
+			quakemlEvent{PublicID: "smi:service.iris.edu/fdsnws/event/1/query?eventid=11745228"},
+			"11745228",
+		},
+		{
+			"query without an eventid",
+			quakemlEvent{PublicID: "quakeml:earthquake.usgs.gov/fdsnws/event/1/query?format=quakeml"},
+			"",
+		},
+		{
+			"smi resource identifier",
+			quakemlEvent{PublicID: "smi:earthquake-visualizer/event/us7000kufc"},
+			"us7000kufc",
+		},
+		{
+			"other scheme",
+			quakemlEvent{PublicID: "quakeml:example.org/event/1"},
+			"",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.ev.eventID(); got != tt.want {
+			t.Errorf("%s: eventID() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestQuakeMLRoundTrip(t *testing.T) {
+	in := Earthquake{
+		EventId:       "us7000kufc",
+		Time:          time.Date(2023, 11, 14, 11, 50, 12, 0, time.UTC),
+		Latitude:      54.8912,
+		Longitude:     -160.2143,
+		Depth:         35.4,
+		Magnitude:     4.7,
+		MagnitudeType: "mww",
+		Place:         "54 km SSE of Sand Point, Alaska",
+	}
+	var buf bytes.Buffer
+	if err := encodeAll(&quakemlEncoder{w: &buf}, []Earthquake{in}); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := parseQuakeML(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || out[0].EventId != in.EventId || !out[0].Time.Equal(in.Time) || out[0].Depth != in.Depth {
+		t.Errorf("round trip gave %+v", out)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// significantBeta is the beta statistic magnitude taken as a significant
+// rate change, roughly the 95% level of a normal distribution
+const significantBeta = 2.0
+
+// timeWindow is a closed period of time
+type timeWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+func (w timeWindow) days() float64 { return daysBetween(w.Start, w.End) }
+
+func (w timeWindow) contains(t time.Time) bool {
+	return !t.Before(w.Start) && !t.After(w.End)
+}
+
+// rateChangeCell compares the rates of one grid cell in the two windows
+type rateChangeCell struct {
+	Latitude        float64      `json:"latitude"`
+	Longitude       float64      `json:"longitude"`
+	Polygon         [][2]float64 `json:"polygon"`
+	BackgroundCount int          `json:"background_count"`
+	ComparisonCount int          `json:"comparison_count"`
+	BackgroundRate  float64      `json:"background_rate"`
+	ComparisonRate  float64      `json:"comparison_rate"`
+	RateRatio       *float64     `json:"rate_ratio"`
+	Beta            float64      `json:"beta"`
+	Significant     bool         `json:"significant"`
+}
+
+// betaStatistic measures how far the n events of the comparison window stray
+// from the number expected if all nTotal events of both windows occurred at
+// a constant rate, with fraction the comparison window's share of the total
+// time (Matthews & Reasenberg, 1988)
+func betaStatistic(n, nTotal int, fraction float64) float64 {
+	expected := float64(nTotal) * fraction
+	return (float64(n) - expected) / math.Sqrt(expected*(1-fraction))
+}
+
+// requestWindow reads a window from its start and end parameters
+func requestWindow(r *http.Request, name string) (timeWindow, error) {
+	query := r.URL.Query()
+	start, err := timeParam(query, name+"_start")
+	if err != nil {
+		return timeWindow{}, err
+	}
+	end, err := timeParam(query, name+"_end")
+	if err != nil {
+		return timeWindow{}, err
+	}
+	if start == nil || end == nil {
+		return timeWindow{}, fmt.Errorf("Missing %s_start or %s_end", name, name)
+	}
+	if !end.After(*start) {
+		return timeWindow{}, fmt.Errorf("%s_end must be after %s_start", name, name)
+	}
+	return timeWindow{*start, *end}, nil
+}
+
+// compare the seismicity rates of a background and a comparison window per
+// grid cell, above the magnitude of completeness, and flag the cells whose
+// rate changed significantly. The getEarthquakes filters select the events,
+// apart from the time range which the windows set.
+func getRateChange(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		filter, status, err := requestFilter(db, r, userID)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		background, err := requestWindow(r, "background")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		comparison, err := requestWindow(r, "comparison")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !background.End.Before(comparison.Start) && !comparison.End.Before(background.Start) {
+			http.Error(w, "The background and comparison windows must not overlap", http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+		size := defaultCellSize
+		if v, err := floatParam(query, "cell_size"); err != nil || (v != nil && (*v <= 0 || *v > 90)) {
+			http.Error(w, "Invalid cell_size value, expected degrees between 0 and 90", http.StatusBadRequest)
+			return
+		} else if v != nil {
+			size = *v
+		}
+		var grid cellGrid = squareGrid{size}
+		switch query.Get("shape") {
+		case "", "square":
+		case "hex":
+			grid = hexGrid{size}
+		default:
+			http.Error(w, "Invalid shape, expected square or hex", http.StatusBadRequest)
+			return
+		}
+
+		// Fetch both windows in one query and sort the events out in Go
+		filter.TimeStart, filter.TimeEnd = &background.Start, &background.End
+		if comparison.Start.Before(background.Start) {
+			filter.TimeStart = &comparison.Start
+		}
+		if comparison.End.After(background.End) {
+			filter.TimeEnd = &comparison.End
+		}
+
+		type windowEvent struct {
+			cell       [2]int
+			comparison bool
+			magnitude  float64
+		}
+		var events []windowEvent
+		var magnitudes []float64
+		err = streamEarthquakes(r.Context(), db, filter, func(e Earthquake) error {
+			inComparison := comparison.contains(e.Time)
+			if !inComparison && !background.contains(e.Time) {
+				return nil
+			}
+			events = append(events, windowEvent{grid.cell(e.Longitude, e.Latitude), inComparison, e.Magnitude})
+			magnitudes = append(magnitudes, e.Magnitude)
+			return nil
+		})
+		if err != nil {
+			log.Println("Error fetching earthquakes for rate change:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		// Only compare events above the magnitude of completeness, so changes
+		// in network detection do not show up as rate changes
+		var mc float64
+		mcMethod := "fixed"
+		if filter.MagnitudeMin != nil {
+			mc = *filter.MagnitudeMin
+		} else if len(magnitudes) > 0 {
+			bins, err := magnitudeDistribution(magnitudes, defaultMagnitudeBin)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			mc = maxCurvatureMc(bins)
+			mcMethod = "maximum curvature"
+		}
+
+		cells := map[[2]int]*rateChangeCell{}
+		for _, e := range events {
+			if e.magnitude < mc-defaultMagnitudeBin/2 {
+				continue
+			}
+			c, ok := cells[e.cell]
+			if !ok {
+				lon, lat := grid.centre(e.cell)
+				c = &rateChangeCell{Latitude: lat, Longitude: lon, Polygon: grid.polygon(e.cell)}
+				cells[e.cell] = c
+			}
+			if e.comparison {
+				c.ComparisonCount++
+			} else {
+				c.BackgroundCount++
+			}
+		}
+
+		fraction := comparison.days() / (comparison.days() + background.days())
+		result := make([]rateChangeCell, 0, len(cells))
+		for _, c := range cells {
+			c.BackgroundRate = float64(c.BackgroundCount) / background.days()
+			c.ComparisonRate = float64(c.ComparisonCount) / comparison.days()
+			if c.BackgroundCount > 0 {
+				ratio := c.ComparisonRate / c.BackgroundRate
+				c.RateRatio = &ratio
+			}
+			c.Beta = betaStatistic(c.ComparisonCount, c.BackgroundCount+c.ComparisonCount, fraction)
+			c.Significant = math.Abs(c.Beta) >= significantBeta
+			result = append(result, *c)
+		}
+		// Largest increases first
+		sort.Slice(result, func(i, j int) bool { return result[i].Beta > result[j].Beta })
+
+		json.NewEncoder(w).Encode(struct {
+			Background timeWindow       `json:"background"`
+			Comparison timeWindow       `json:"comparison"`
+			Mc         float64          `json:"mc"`
+			McMethod   string           `json:"mc_method"`
+			CellSize   float64          `json:"cell_size"`
+			Cells      []rateChangeCell `json:"cells"`
+		}{background, comparison, mc, mcMethod, size, result})
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Region is a named GeoJSON Polygon or MultiPolygon saved by a user for
+// reuse as an earthquake search area
+type Region struct {
+	Id       int             `json:"id"`
+	UserId   int             `json:"user_id"`
+	Name     string          `json:"name"`
+	Geometry json.RawMessage `json:"geometry"`
+}
+
+// maxAreaBytes caps request bodies carrying a GeoJSON area, which is
+// generous for a detailed country border
+const maxAreaBytes = 1 << 20
+
+// bodyStatus is the status for an error reading a request body limited by
+// http.MaxBytesReader
+func bodyStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// validateRegion checks an optional preference region is a usable area
+func validateRegion(region json.RawMessage) error {
+	if len(region) == 0 || string(region) == "null" {
+		return nil
+	}
+	_, err := parseArea(region)
+	return err
+}
+
+// regionParam converts an optional region to a JSONB query argument
+func regionParam(region json.RawMessage) interface{} {
+	if len(region) == 0 || string(region) == "null" {
+		return nil
+	}
+	return string(region)
+}
+
+// loadRegionArea fetches a user's stored region as an area filter
+func loadRegionArea(db *sql.DB, regionID int, userID string) (*areaFilter, error) {
+	var geometry []byte
+	err := db.QueryRow("SELECT geometry FROM regions WHERE id = $1 AND user_id = $2", regionID, userID).Scan(&geometry)
+	if err != nil {
+		return nil, err
+	}
+	return parseArea(geometry)
+}
+
+// requestArea returns the polygon filter of an earthquake search, taken from
+// the POST body or a stored region_id parameter, or nil if there is none
+func requestArea(db *sql.DB, r *http.Request, userID string) (*areaFilter, int, error) {
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxAreaBytes))
+		if err != nil {
+			return nil, bodyStatus(err), err
+		}
+		area, err := parseArea(body)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return area, 0, nil
+	}
+
+	val := r.URL.Query().Get("region_id")
+	if val == "" {
+		return nil, 0, nil
+	}
+	regionID, err := strconv.Atoi(val)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("region_id must be an integer, got %q", val)
+	}
+	area, err := loadRegionArea(db, regionID, userID)
+	if err == sql.ErrNoRows {
+		return nil, http.StatusNotFound, err
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return area, 0, nil
+}
+
+func getRegions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		rows, err := db.Query("SELECT id, user_id, name, geometry FROM regions WHERE user_id = $1 ORDER BY id", userID)
+		if err != nil {
+			log.Println("Error fetching regions:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		regions := []Region{}
+		for rows.Next() {
+			var reg Region
+			var geometry []byte
+			if err := rows.Scan(&reg.Id, &reg.UserId, &reg.Name, &geometry); err != nil {
+				log.Println("Error scanning region:", err)
+				continue
+			}
+			reg.Geometry = geometry
+			regions = append(regions, reg)
+		}
+
+		json.NewEncoder(w).Encode(regions)
+	}
+}
+
+func createRegion(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var reg Region
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAreaBytes)).Decode(&reg); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), bodyStatus(err))
+			return
+		}
+		if reg.Name == "" {
+			http.Error(w, "Missing required field: name", http.StatusBadRequest)
+			return
+		}
+		if _, err := parseArea(reg.Geometry); err != nil {
+			http.Error(w, "Invalid geometry: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = db.QueryRow(
+			"INSERT INTO regions (user_id, name, geometry) VALUES ($1, $2, $3) RETURNING id, user_id",
+			userID, reg.Name, string(reg.Geometry),
+		).Scan(&reg.Id, &reg.UserId)
+		if err != nil {
+			log.Println("Error creating region:", err)
+			http.Error(w, "Failed to create region", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(reg)
+	}
+}
+
+func getRegion(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+
+		var reg Region
+		var geometry []byte
+		err = db.QueryRow("SELECT id, user_id, name, geometry FROM regions WHERE id = $1 AND user_id = $2", id, userID).Scan(
+			&reg.Id, &reg.UserId, &reg.Name, &geometry,
+		)
+		if err != nil {
+			http.Error(w, "Region not found", http.StatusNotFound)
+			return
+		}
+		reg.Geometry = geometry
+
+		json.NewEncoder(w).Encode(reg)
+	}
+}
+
+func deleteRegion(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+
+		_, err = db.Exec("DELETE FROM regions WHERE id = $1 AND user_id = $2", id, userID)
+		if err != nil {
+			log.Println("Error deleting region:", err)
+			http.Error(w, "Failed to delete region", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Shaking grid limits. The grid is square around the epicentre, with
+// shakeMapCells cells along each side unless a spacing is given.
+const (
+	defaultShakeMapRadiusKm = 200.0
+	maxShakeMapRadiusKm     = 1000.0
+	shakeMapCells           = 50
+	maxShakeMapCells        = 200
+
+	// shakeMapCircleVertices is the number of vertices of contour polygons
+	shakeMapCircleVertices = 72
+)
+
+// shakeMapGrid is predicted MMI on a regular latitude/longitude grid, with
+// MMI[i][j] at Latitudes[i], Longitudes[j]. Longitudes are not wrapped at
+// the antimeridian.
+type shakeMapGrid struct {
+	Latitudes  []float64   `json:"latitudes"`
+	Longitudes []float64   `json:"longitudes"`
+	MMI        [][]float64 `json:"mmi"`
+}
+
+// shakingAt is the predicted MMI at epicentral distance km, attenuated over
+// the hypocentral distance as in estimateShaking
+func shakingAt(e Earthquake, km, vs30 float64) float64 {
+	return wordenMMI(bjf97PGA(e.Magnitude, hypocentralKm(km, e.Depth), vs30) * gravityCmS2)
+}
+
+// mmiRadiusKm finds by bisection the epicentral distance within maxKm where
+// the predicted intensity falls to mmi. The GMPE depends on distance alone,
+// so intensity decreases steadily away from the epicentre and each contour
+// is a circle. It returns false if mmi is not reached at the epicentre,
+// which for a deep event may be well below its magnitude's usual maximum.
+func mmiRadiusKm(e Earthquake, mmi, vs30, maxKm float64) (float64, bool) {
+	if shakingAt(e, 0, vs30) < mmi {
+		return 0, false
+	}
+	lo, hi := 0.0, maxKm
+	if shakingAt(e, hi, vs30) >= mmi {
+		return hi, true
+	}
+	for hi-lo > 0.01 {
+		mid := (lo + hi) / 2
+		if shakingAt(e, mid, vs30) >= mmi {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, true
+}
+
+// render a ShakeMap-style raster of predicted intensity around an earthquake
+// with the same GMPE and GMICE as getSiteShaking, on a uniform site Vs30.
+// format=geojson returns nested polygons of the area at or above each whole
+// intensity instead of the grid. outside_valid_range flags maps of events
+// beyond the magnitude or depth range of BJF97, and contours beyond its
+// distance range.
+func getShakeMap(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := getUserIDFromContext(r.Context()); err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		query := r.URL.Query()
+		radiusKm := defaultShakeMapRadiusKm
+		if v, err := floatParam(query, "radius_km"); err != nil || (v != nil && (*v <= 0 || *v > maxShakeMapRadiusKm)) {
+			http.Error(w, "Invalid radius_km value, expected at most 1000 km", http.StatusBadRequest)
+			return
+		} else if v != nil {
+			radiusKm = *v
+		}
+		spacingKm := 2 * radiusKm / shakeMapCells
+		if v, err := floatParam(query, "spacing_km"); err != nil || (v != nil && (*v <= 0 || 2*radiusKm / *v > maxShakeMapCells)) {
+			http.Error(w, "Invalid spacing_km value, expected at most 200 cells across", http.StatusBadRequest)
+			return
+		} else if v != nil {
+			spacingKm = *v
+		}
+		vs30 := defaultVs30
+		if v, err := floatParam(query, "vs30"); err != nil || (v != nil && *v <= 0) {
+			http.Error(w, "Invalid vs30 value", http.StatusBadRequest)
+			return
+		} else if v != nil {
+			vs30 = *v
+		}
+		format := query.Get("format")
+		if format != "" && format != "grid" && format != "geojson" {
+			http.Error(w, "Invalid format, expected grid or geojson", http.StatusBadRequest)
+			return
+		}
+
+		e, err := findEarthquake(r, db, mux.Vars(r)["id"])
+		if err == sql.ErrNoRows {
+			http.Error(w, "Earthquake not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Error fetching earthquake:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		if format == "geojson" {
+			features := []geoJSONFeature{}
+			for level := 2; level <= 10; level++ {
+				km, ok := mmiRadiusKm(e, float64(level), vs30, radiusKm)
+				if !ok {
+					break
+				}
+				ring := make([][2]float64, 0, shakeMapCircleVertices+1)
+				for i := 0; i <= shakeMapCircleVertices; i++ {
+					// Step the bearing down from 360 so the ring runs
+					// counter-clockwise, as GeoJSON exteriors should
+					bearing := 360 * float64(shakeMapCircleVertices-i%shakeMapCircleVertices) / shakeMapCircleVertices
+					lat, lon := destinationPoint(e.Latitude, e.Longitude, bearing, km)
+					ring = append(ring, [2]float64{lon, lat})
+				}
+				features = append(features, geoJSONFeature{
+					Type:     "Feature",
+					Geometry: geoJSONGeometry{Type: "Polygon", Coordinates: [][][2]float64{ring}},
+					Properties: map[string]interface{}{
+						"mmi":       level,
+						"intensity": romanNumerals[level-1],
+						"shaking":   mmiLabels[level-1],
+						"radius_km": km,
+						// The contour lies beyond radius_km and was cut off there
+						"clipped":             km >= radiusKm,
+						"outside_valid_range": bjf97OutsideRange(e.Magnitude, e.Depth, hypocentralKm(km, e.Depth)),
+					},
+				})
+			}
+			w.Header().Set("Content-Type", "application/geo+json")
+			json.NewEncoder(w).Encode(struct {
+				Type     string           `json:"type"`
+				Features []geoJSONFeature `json:"features"`
+			}{"FeatureCollection", features})
+			return
+		}
+
+		// Step the grid in degrees matching spacingKm at the epicentre
+		latStep := spacingKm / kmPerDegree
+		lonStep := latStep / math.Max(math.Cos(radians(e.Latitude)), 0.01)
+		n := int(math.Round(2 * radiusKm / spacingKm))
+		grid := shakeMapGrid{}
+		for i := 0; i <= n; i++ {
+			lat := e.Latitude + (float64(i)-float64(n)/2)*latStep
+			if lat < -90 || lat > 90 {
+				continue
+			}
+			grid.Latitudes = append(grid.Latitudes, lat)
+		}
+		for j := 0; j <= n; j++ {
+			grid.Longitudes = append(grid.Longitudes, e.Longitude+(float64(j)-float64(n)/2)*lonStep)
+		}
+		for _, lat := range grid.Latitudes {
+			row := make([]float64, len(grid.Longitudes))
+			for j, lon := range grid.Longitudes {
+				row[j] = math.Round(shakingAt(e, haversineKm(e.Latitude, e.Longitude, lat, lon), vs30)*100) / 100
+			}
+			grid.MMI = append(grid.MMI, row)
+		}
+
+		// The grid is flagged for the event alone; cells beyond the distance
+		// range of BJF97 are always extrapolated
+		json.NewEncoder(w).Encode(struct {
+			Earthquake        Earthquake   `json:"earthquake"`
+			Model             string       `json:"model"`
+			OutsideValidRange bool         `json:"outside_valid_range"`
+			Vs30              float64      `json:"vs30"`
+			SpacingKm         float64      `json:"spacing_km"`
+			Grid              shakeMapGrid `json:"grid"`
+		}{e, shakingModel, bjf97OutsideRange(e.Magnitude, e.Depth, 0), vs30, spacingKm, grid})
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMMIRadiusKmDepth(t *testing.T) {
+	shallow := Earthquake{Latitude: 35.77, Longitude: -117.6, Magnitude: 7, Depth: 8}
+	deep := Earthquake{Latitude: -17.9, Longitude: -178.5, Magnitude: 7, Depth: 600}
+
+	km, ok := mmiRadiusKm(shallow, 5, defaultVs30, maxShakeMapRadiusKm)
+	if !ok || km <= 0 || km >= maxShakeMapRadiusKm {
+		t.Fatalf("MMI V radius of a shallow M7 = %g, %t", km, ok)
+	}
+	if got := shakingAt(shallow, km, defaultVs30); math.Abs(got-5) > 0.01 {
+		t.Errorf("MMI at the MMI V radius = %g", got)
+	}
+
+	// The epicentre of a deep event is 600 km from its source, too far for
+	// MMI V however large the grid
+	if km, ok := mmiRadiusKm(deep, 5, defaultVs30, maxShakeMapRadiusKm); ok {
+		t.Errorf("a 600 km deep M7 reached MMI V out to %g km", km)
+	}
+	if shakingAt(deep, 0, defaultVs30) >= shakingAt(shallow, 0, defaultVs30) {
+		t.Error("a deep event shakes its epicentre as hard as a shallow one")
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// defaultMagnitudeBin is the magnitude bin width used when none is given,
+// matching the 0.1 precision most catalogs report magnitudes to
+const defaultMagnitudeBin = 0.1
+
+// Magnitude bin limits. Bins narrower than a hundredth of a magnitude unit
+// are finer than any catalog reports, and maxMagnitudeBins bounds the
+// distribution a wide range of magnitudes can produce.
+const (
+	minMagnitudeBin  = 0.01
+	maxMagnitudeBin  = 1.0
+	maxMagnitudeBins = 10000
+)
+
+var errTooManyMagnitudeBins = errors.New("Too many magnitude bins, use a wider bin_width or narrow the filters")
+
+// magnitudeBin is one bin of a frequency-magnitude distribution
+type magnitudeBin struct {
+	Magnitude   float64 `json:"magnitude"`
+	Incremental int     `json:"incremental"`
+	Cumulative  int     `json:"cumulative"`
+}
+
+// gutenbergRichter is a Gutenberg-Richter fit, log10 N(>=M) = a - bM, with
+// the distribution it was estimated from. The fit fields are omitted when
+// there are too few events above the magnitude of completeness.
+type gutenbergRichter struct {
+	Count         int            `json:"count"`
+	BinWidth      float64        `json:"bin_width"`
+	Mc            *float64       `json:"mc"`
+	McMethod      string         `json:"mc_method"`
+	CountAboveMc  int            `json:"count_above_mc"`
+	MeanMagnitude *float64       `json:"mean_magnitude,omitempty"`
+	BValue        *float64       `json:"b_value,omitempty"`
+	BUncertainty  *float64       `json:"b_uncertainty,omitempty"`
+	AValue        *float64       `json:"a_value,omitempty"`
+	Bins          []magnitudeBin `json:"bins"`
+}
+
+// binMagnitude rounds a magnitude to the centre of its bin, dropping the
+// floating point noise of the multiplication
+func binMagnitude(m, width float64) float64 {
+	return math.Round(math.Round(m/width)*width*1e6) / 1e6
+}
+
+// magnitudeDistribution bins magnitudes into the incremental and cumulative
+// distributions, from the smallest populated bin to the largest
+func magnitudeDistribution(magnitudes []float64, width float64) ([]magnitudeBin, error) {
+	if len(magnitudes) == 0 {
+		return []magnitudeBin{}, nil
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, m := range magnitudes {
+		i := math.Round(m / width)
+		lo, hi = math.Min(lo, i), math.Max(hi, i)
+	}
+	if !(hi-lo < maxMagnitudeBins) {
+		return nil, errTooManyMagnitudeBins
+	}
+
+	bins := make([]magnitudeBin, int(hi-lo)+1)
+	for i := range bins {
+		bins[i].Magnitude = binMagnitude((lo+float64(i))*width, width)
+	}
+	for _, m := range magnitudes {
+		bins[int(math.Round(m/width)-lo)].Incremental++
+	}
+	total := 0
+	for i := len(bins) - 1; i >= 0; i-- {
+		total += bins[i].Incremental
+		bins[i].Cumulative = total
+	}
+	return bins, nil
+}
+
+// maxCurvatureMc estimates the magnitude of completeness as the bin with the
+// most events, the point of maximum curvature of the cumulative distribution
+// (Wiemer & Wyss, 2000)
+func maxCurvatureMc(bins []magnitudeBin) float64 {
+	best := 0
+	for i, b := range bins {
+		if b.Incremental > bins[best].Incremental {
+			best = i
+		}
+	}
+	return bins[best].Magnitude
+}
+
+// fitGutenbergRichter estimates b by maximum likelihood (Aki, 1965, with
+// Utsu's correction for binned magnitudes), its uncertainty after Shi & Bolt
+// (1982), and a from the number of events at or above mc
+func fitGutenbergRichter(gr *gutenbergRichter, magnitudes []float64, mc float64) {
+	// Compare bin centres with a tolerance so mc's own bin is included
+	var above []float64
+	for _, m := range magnitudes {
+		if binned := binMagnitude(m, gr.BinWidth); binned >= mc-gr.BinWidth/1e3 {
+			above = append(above, binned)
+		}
+	}
+	gr.CountAboveMc = len(above)
+	if len(above) < 2 {
+		return
+	}
+
+	n := float64(len(above))
+	mean := 0.0
+	for _, m := range above {
+		mean += m
+	}
+	mean /= n
+	gr.MeanMagnitude = &mean
+
+	if mean <= mc-gr.BinWidth/2 {
+		return
+	}
+	b := math.Log10(math.E) / (mean - (mc - gr.BinWidth/2))
+
+	variance := 0.0
+	for _, m := range above {
+		variance += (m - mean) * (m - mean)
+	}
+	sigma := 2.3 * b * b * math.Sqrt(variance/(n*(n-1)))
+	a := math.Log10(n) + b*mc
+
+	gr.BValue, gr.BUncertainty, gr.AValue = &b, &sigma, &a
+}
+
+// estimate the Gutenberg-Richter magnitude-frequency relation of the
+// earthquakes matching the getEarthquakes filters
+func getGutenbergRichter(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		filter, status, err := requestFilter(db, r, userID)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		query := r.URL.Query()
+		width := defaultMagnitudeBin
+		if v, err := floatParam(query, "bin_width"); err != nil || (v != nil && !(*v >= minMagnitudeBin && *v <= maxMagnitudeBin)) {
+			http.Error(w, "Invalid bin_width value, expected between 0.01 and 1", http.StatusBadRequest)
+			return
+		} else if v != nil {
+			width = *v
+		}
+		fixedMc, err := floatParam(query, "mc")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var magnitudes []float64
+		err = streamEarthquakes(r.Context(), db, filter, func(e Earthquake) error {
+			magnitudes = append(magnitudes, e.Magnitude)
+			return nil
+		})
+		if err != nil {
+			log.Println("Error fetching magnitudes:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		bins, err := magnitudeDistribution(magnitudes, width)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gr := gutenbergRichter{
+			Count:    len(magnitudes),
+			BinWidth: width,
+			McMethod: "maximum curvature",
+			Bins:     bins,
+		}
+		if len(gr.Bins) > 0 || fixedMc != nil {
+			var mc float64
+			if fixedMc != nil {
+				mc = binMagnitude(*fixedMc, width)
+				gr.McMethod = "fixed"
+			} else {
+				mc = maxCurvatureMc(gr.Bins)
+			}
+			gr.Mc = &mc
+			fitGutenbergRichter(&gr, magnitudes, mc)
+		}
+
+		log.Printf("Gutenberg-Richter fit of %d earthquakes, %d above Mc", gr.Count, gr.CountAboveMc)
+		json.NewEncoder(w).Encode(gr)
+	}
+}
+
+// seismicEnergyJoules is the radiated energy of an earthquake from the
+// Gutenberg-Richter energy-magnitude relation, log10 E = 1.5M + 4.8
+func seismicEnergyJoules(magnitude float64) float64 {
+	return math.Pow(10, 1.5*magnitude+4.8)
+}
+
+// timeBucket is one interval of an activity time series. Magnitude and depth
+// are null for intervals without earthquakes.
+type timeBucket struct {
+	Start        time.Time `json:"start"`
+	Count        int       `json:"count"`
+	MaxMagnitude *float64  `json:"max_magnitude"`
+	MeanDepth    *float64  `json:"mean_depth"`
+	EnergyJoules float64   `json:"energy_joules"`
+}
+
+// bucketIntervals truncate a UTC time to the start of its bucket and step to
+// the next one. Weeks start on Monday, as with PostgreSQL's date_trunc.
+var bucketIntervals = map[string]struct {
+	truncate func(time.Time) time.Time
+	next     func(time.Time) time.Time
+}{
+	"hour": {
+		func(t time.Time) time.Time { return t.Truncate(time.Hour) },
+		func(t time.Time) time.Time { return t.Add(time.Hour) },
+	},
+	"day": {
+		func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC) },
+		func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+	},
+	"week": {
+		func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day()-(int(t.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+		},
+		func(t time.Time) time.Time { return t.AddDate(0, 0, 7) },
+	},
+	"month": {
+		func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC) },
+		func(t time.Time) time.Time { return t.AddDate(0, 1, 0) },
+	},
+}
+
+// maxTimeBuckets caps a time series so a fine interval over a long filter
+// range cannot produce an unbounded response
+const maxTimeBuckets = 100000
+
+var errTooManyBuckets = errors.New("Too many buckets, use a longer interval or a shorter time range")
+
+// bucketRange returns the empty buckets from the one holding start to the one
+// holding end
+func bucketRange(name string, start, end time.Time) ([]timeBucket, error) {
+	interval := bucketIntervals[name]
+	buckets := []timeBucket{}
+	for t := interval.truncate(start.UTC()); !t.After(end); t = interval.next(t) {
+		if len(buckets) == maxTimeBuckets {
+			return nil, errTooManyBuckets
+		}
+		buckets = append(buckets, timeBucket{Start: t})
+	}
+	return buckets, nil
+}
+
+// aggregate earthquakes matching the getEarthquakes filters into a time
+// series of counts, largest magnitude, mean depth and energy release. The
+// series spans time_start to time_end when both are given, and the first
+// to the last earthquake otherwise.
+func getTimeSeries(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		filter, status, err := requestFilter(db, r, userID)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		name := r.URL.Query().Get("interval")
+		if name == "" {
+			name = "day"
+		}
+		interval, ok := bucketIntervals[name]
+		if !ok {
+			http.Error(w, "Invalid interval, expected hour, day, week or month", http.StatusBadRequest)
+			return
+		}
+
+		// Rows arrive in time order, so each bucket is finished before the next starts
+		filter.OrderBy, filter.Descending = "time", false
+		buckets := []timeBucket{}
+		if filter.TimeStart != nil && filter.TimeEnd != nil {
+			// Lay out the whole range so quiet periods at either end show as empty buckets
+			if buckets, err = bucketRange(name, *filter.TimeStart, *filter.TimeEnd); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		var depthSum float64
+		current := 0 // the bucket being filled
+		finish := func() {
+			if current < len(buckets) && buckets[current].Count > 0 {
+				mean := depthSum / float64(buckets[current].Count)
+				buckets[current].MeanDepth = &mean
+			}
+			depthSum = 0
+		}
+		err = streamEarthquakes(r.Context(), db, filter, func(e Earthquake) error {
+			start := interval.truncate(e.Time.UTC())
+			if len(buckets) == 0 {
+				buckets = append(buckets, timeBucket{Start: start})
+			}
+			// Step through any empty buckets so the series has no gaps
+			for current < len(buckets)-1 && buckets[current].Start.Before(start) {
+				finish()
+				current++
+			}
+			for buckets[current].Start.Before(start) {
+				finish()
+				if len(buckets) == maxTimeBuckets {
+					return errTooManyBuckets
+				}
+				buckets = append(buckets, timeBucket{Start: interval.next(buckets[current].Start)})
+				current++
+			}
+
+			b := &buckets[current]
+			b.Count++
+			if b.MaxMagnitude == nil || e.Magnitude > *b.MaxMagnitude {
+				m := e.Magnitude
+				b.MaxMagnitude = &m
+			}
+			depthSum += e.Depth
+			b.EnergyJoules += seismicEnergyJoules(e.Magnitude)
+			return nil
+		})
+		if err == errTooManyBuckets {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println("Error aggregating earthquakes:", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		finish()
+
+		json.NewEncoder(w).Encode(struct {
+			Interval string       `json:"interval"`
+			Buckets  []timeBucket `json:"buckets"`
+		}{name, buckets})
+	}
+}
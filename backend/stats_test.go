@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// syntheticCatalog draws n magnitudes from a Gutenberg-Richter distribution
+// with the given b-value, complete from mc, plus a tail of detected events
+// below mc whose counts fall off towards smaller magnitudes
+func syntheticCatalog(rng *rand.Rand, n int, b, mc float64) []float64 {
+	beta := b * math.Ln10
+	var magnitudes []float64
+	for i := 0; i < n; i++ {
+		// Start half a bin below mc so binning leaves mc's bin complete
+		magnitudes = append(magnitudes, mc-defaultMagnitudeBin/2+rng.ExpFloat64()/beta)
+	}
+	for k := 1; k <= 10; k++ {
+		m := mc - float64(k)*defaultMagnitudeBin
+		for i := 0; i < n/(10*k); i++ {
+			magnitudes = append(magnitudes, m)
+		}
+	}
+	return magnitudes
+}
+
+func TestFitGutenbergRichter(t *testing.T) {
+	const n, b, mc = 20000, 1.0, 2.0
+	magnitudes := syntheticCatalog(rand.New(rand.NewSource(1)), n, b, mc)
+
+	bins, err := magnitudeDistribution(magnitudes, defaultMagnitudeBin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := maxCurvatureMc(bins); got != mc {
+		t.Errorf("maxCurvatureMc = %g, want %g", got, mc)
+	}
+
+	gr := gutenbergRichter{BinWidth: defaultMagnitudeBin, Bins: bins}
+	fitGutenbergRichter(&gr, magnitudes, mc)
+	if gr.CountAboveMc != n {
+		t.Errorf("CountAboveMc = %d, want %d", gr.CountAboveMc, n)
+	}
+	if gr.BValue == nil || math.Abs(*gr.BValue-b) > 0.03 {
+		t.Fatalf("b = %v, want %g ± 0.03", gr.BValue, b)
+	}
+
+	// For an exponential distribution the Shi & Bolt uncertainty tends to
+	// 2.3 b² σ(M) / √n with σ(M) = log10(e) / b
+	want := 2.3 * b * math.Log10(math.E) / math.Sqrt(n)
+	if got := *gr.BUncertainty; math.Abs(got-want)/want > 0.1 {
+		t.Errorf("b uncertainty = %g, want about %g", got, want)
+	}
+	if got, want := *gr.AValue, math.Log10(n)+*gr.BValue*mc; math.Abs(got-want) > 1e-9 {
+		t.Errorf("a = %g, want %g", got, want)
+	}
+}
+
+func TestFitGutenbergRichterTooFewEvents(t *testing.T) {
+	gr := gutenbergRichter{BinWidth: defaultMagnitudeBin}
+	fitGutenbergRichter(&gr, []float64{3.1}, 3.0)
+	if gr.CountAboveMc != 1 || gr.BValue != nil || gr.AValue != nil {
+		t.Errorf("fit of one event = %+v", gr)
+	}
+}
+
+func TestMagnitudeDistribution(t *testing.T) {
+	bins, err := magnitudeDistribution([]float64{2.04, 2.1, 2.1, 2.36, 2.4}, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []magnitudeBin{
+		{2.0, 1, 5},
+		{2.1, 2, 4},
+		{2.2, 0, 2},
+		{2.3, 0, 2},
+		{2.4, 2, 2},
+	}
+	if len(bins) != len(want) {
+		t.Fatalf("got %d bins, want %d: %+v", len(bins), len(want), bins)
+	}
+	for i := range want {
+		if bins[i] != want[i] {
+			t.Errorf("bin %d = %+v, want %+v", i, bins[i], want[i])
+		}
+	}
+
+	if _, err := magnitudeDistribution([]float64{0, 2000}, 0.1); err != errTooManyMagnitudeBins {
+		t.Errorf("a 2000 magnitude unit range gave %v, want errTooManyMagnitudeBins", err)
+	}
+}
+
+func TestBucketRange(t *testing.T) {
+	start := time.Date(2024, 1, 30, 18, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	buckets, err := bucketRange("month", start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, b := range buckets {
+		if b.Count != 0 || b.MeanDepth != nil {
+			t.Errorf("padding bucket %+v is not empty", b)
+		}
+		got = append(got, b.Start.Format("2006-01-02"))
+	}
+	// The range ends on the first instant of April, which falls in April's bucket
+	want := []string{"2024-01-01", "2024-02-01", "2024-03-01", "2024-04-01"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bucketRange = %v, want %v", got, want)
+	}
+
+	if _, err := bucketRange("hour", start, start.AddDate(20, 0, 0)); err != errTooManyBuckets {
+		t.Errorf("20 years of hours gave %v, want errTooManyBuckets", err)
+	}
+}
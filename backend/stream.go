@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// earthquakeEncoder writes earthquakes one at a time, so a response can be
+// streamed straight from the database rows without collecting them first
+type earthquakeEncoder interface {
+	begin() error
+	encode(e Earthquake) error
+	end() error
+}
+
+type encoderOptions struct {
+	// withDistance adds distance and bearing columns to CSV output
+	withDistance bool
+	geojson      geoJSONMetadata
+}
+
+// flushEvery is how many streamed earthquakes are written between flushes
+const flushEvery = 500
+
+// newEarthquakeEncoder returns the encoder for a format accepted by negotiateFormat
+func newEarthquakeEncoder(w io.Writer, format string, opts encoderOptions) earthquakeEncoder {
+	switch format {
+	case "quakeml":
+		return &quakemlEncoder{w: w}
+	case "geojson":
+		return &geoJSONEncoder{w: w, meta: opts.geojson}
+	case "csv":
+		return newCSVEncoder(w, opts.withDistance)
+	case "kml":
+		return &kmlEncoder{w: w}
+	case "ndjson":
+		return &ndjsonEncoder{encoder: json.NewEncoder(w)}
+	default:
+		return &jsonArrayEncoder{w: w}
+	}
+}
+
+// setFormatHeaders replaces the default JSON content type with the format's
+// own, marking export formats as file downloads
+func setFormatHeaders(w http.ResponseWriter, format string) {
+	switch format {
+	case "quakeml":
+		w.Header().Set("Content-Type", "application/xml")
+	case "geojson":
+		w.Header().Set("Content-Type", "application/geo+json")
+	case "csv", "kml", "ndjson":
+		f := exportFormats[format]
+		w.Header().Set("Content-Type", f.contentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="earthquakes.`+f.extension+`"`)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+	}
+}
+
+// encodeAll writes a complete document for an already fetched result set
+func encodeAll(enc earthquakeEncoder, earthquakes []Earthquake) error {
+	if err := enc.begin(); err != nil {
+		return err
+	}
+	for _, e := range earthquakes {
+		if err := enc.encode(e); err != nil {
+			return err
+		}
+	}
+	return enc.end()
+}
+
+// streamEarthquakeResponse runs the filter and encodes each row as it is read,
+// flushing the response every flushEvery rows. setHeaders and enc.begin are
+// only called once the first row arrives, so a query that fails up front can
+// still be answered with an error status, and an empty result writes nothing.
+// It returns the number of rows written; enc.end is left to the caller.
+func streamEarthquakeResponse(ctx context.Context, w http.ResponseWriter, db *sql.DB, f earthquakeFilter,
+	enc earthquakeEncoder, setHeaders func()) (int, error) {
+	flusher, _ := w.(http.Flusher)
+	n := 0
+	err := streamEarthquakes(ctx, db, f, func(e Earthquake) error {
+		if n == 0 {
+			setHeaders()
+			if err := enc.begin(); err != nil {
+				return err
+			}
+		}
+		if err := enc.encode(e); err != nil {
+			return err
+		}
+		n++
+		if flusher != nil && n%flushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	return n, err
+}
+
+// distanceEncoder adds the distance and bearing from a search point to each
+// earthquake before passing it on
+type distanceEncoder struct {
+	earthquakeEncoder
+	latitude, longitude float64
+}
+
+func (d *distanceEncoder) encode(e Earthquake) error {
+	e.setDistanceFrom(d.latitude, d.longitude)
+	return d.earthquakeEncoder.encode(e)
+}
+
+// jsonArrayEncoder writes a plain JSON array of earthquakes
+type jsonArrayEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func (j *jsonArrayEncoder) begin() error {
+	_, err := io.WriteString(j.w, "[")
+	return err
+}
+
+func (j *jsonArrayEncoder) encode(e Earthquake) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if j.count > 0 {
+		if _, err := io.WriteString(j.w, ","); err != nil {
+			return err
+		}
+	}
+	j.count++
+	_, err = j.w.Write(b)
+	return err
+}
+
+func (j *jsonArrayEncoder) end() error {
+	_, err := io.WriteString(j.w, "]\n")
+	return err
+}
+
+// ndjsonEncoder writes one JSON object per line
+type ndjsonEncoder struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonEncoder) begin() error { return nil }
+
+func (n *ndjsonEncoder) encode(e Earthquake) error { return n.encoder.Encode(e) }
+
+func (n *ndjsonEncoder) end() error { return nil }